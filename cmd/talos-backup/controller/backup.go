@@ -0,0 +1,373 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+	talosconfig "github.com/siderolabs/talos/pkg/machinery/client/config"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/siderolabs/talos-backup/cmd/talos-backup/service"
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+	"github.com/siderolabs/talos-backup/pkg/notify"
+	"github.com/siderolabs/talos-backup/pkg/s3"
+)
+
+// backup runs a backup for schedule, recording it as an EtcdBackup resource.
+func (c *controller) backup(ctx context.Context, schedule *EtcdBackupSchedule) {
+	logger := logging.FromContext(ctx)
+	start := time.Now()
+	name := fmt.Sprintf("%s-%d", schedule.Name, start.Unix())
+
+	if err := c.createBackup(ctx, schedule, name, start); err != nil {
+		logger.Error("failed to create backup resource", logging.Error(err))
+
+		return
+	}
+
+	ctx = logging.With(ctx, "backup", name)
+	logger = logging.FromContext(ctx)
+
+	serviceConfig, result, err := c.runBackup(ctx, schedule)
+
+	now := metav1.Now()
+	status := EtcdBackupStatus{
+		CompletionTime: &now,
+		Duration:       time.Since(start).Round(time.Second).String(),
+		Bucket:         serviceConfig.Bucket,
+		ObjectKeys:     result.ObjectKeys,
+	}
+
+	if len(result.ObjectKeys) > 0 {
+		status.Storage = destinationOf(serviceConfig)
+	}
+
+	switch {
+	case err != nil:
+		logger.Error("backup failed", logging.Error(err))
+
+		status.Phase = PhaseFailed
+		status.Conditions = []metav1.Condition{{
+			Type:               ConditionFailed,
+			Status:             metav1.ConditionTrue,
+			Reason:             notify.ReasonBackupFailed,
+			Message:            err.Error(),
+			LastTransitionTime: now,
+		}}
+	case result.Skipped:
+		status.Phase = PhaseSkipped
+		status.Conditions = []metav1.Condition{{
+			Type:               ConditionSkipped,
+			Status:             metav1.ConditionTrue,
+			Reason:             notify.ReasonBackupSkipped,
+			Message:            "another backup of the cluster holds the lock",
+			LastTransitionTime: now,
+		}}
+	default:
+		status.Phase = PhaseSucceeded
+		status.ObjectKey = result.ObjectKey
+		status.Size = result.Size
+		status.Conditions = []metav1.Condition{{
+			Type:               ConditionComplete,
+			Status:             metav1.ConditionTrue,
+			Reason:             notify.ReasonBackupSucceeded,
+			Message:            fmt.Sprintf("uploaded %s (%d bytes)", result.ObjectKey, result.Size),
+			LastTransitionTime: now,
+		}}
+	}
+
+	// record the outcome even if the controller is shutting down
+	ctx = context.WithoutCancel(ctx)
+
+	if err = c.patchStatus(ctx, backupResource, name, status); err != nil {
+		logger.Error("failed to update backup status", logging.Error(err))
+	}
+
+	if status.Phase != PhaseSucceeded {
+		return
+	}
+
+	if err = c.patchStatus(ctx, scheduleResource, schedule.Name, EtcdBackupScheduleStatus{LastSuccessfulTime: &now, LastBackup: name}); err != nil {
+		logger.Error("failed to update backup schedule status", logging.Error(err))
+	}
+
+	if err = c.prune(ctx, schedule, serviceConfig); err != nil {
+		logger.Error("failed to prune old backups", logging.Error(err))
+	}
+}
+
+// createBackup creates the EtcdBackup resource name owned by schedule.
+func (c *controller) createBackup(ctx context.Context, schedule *EtcdBackupSchedule, name string, start time.Time) error {
+	isController := true
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&EtcdBackup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: Group + "/" + Version,
+			Kind:       "EtcdBackup",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: c.namespace,
+			Labels:    map[string]string{LabelSchedule: schedule.Name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: Group + "/" + Version,
+				Kind:       "EtcdBackupSchedule",
+				Name:       schedule.Name,
+				UID:        schedule.UID,
+				Controller: &isController,
+			}},
+		},
+		Spec: EtcdBackupSpec{Schedule: schedule.Name},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.dynamicClient.Resource(backupResource).Namespace(c.namespace).Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	return c.patchStatus(ctx, backupResource, name, EtcdBackupStatus{StartTime: &metav1.Time{Time: start}, Phase: PhaseRunning})
+}
+
+// runBackup backs up the cluster of schedule, returning the service config it used.
+func (c *controller) runBackup(ctx context.Context, schedule *EtcdBackupSchedule) (*config.ServiceConfig, service.Result, error) {
+	serviceConfig, err := c.backupConfig(ctx, schedule)
+	if err != nil {
+		return serviceConfig, service.Result{}, err
+	}
+
+	var talosConfig *talosconfig.Config
+
+	if ref := schedule.Spec.TalosConfigSecretRef; ref != nil {
+		data, secretErr := c.secretValue(ctx, *ref)
+		if secretErr != nil {
+			return serviceConfig, service.Result{}, secretErr
+		}
+
+		talosConfig, err = talosconfig.FromBytes(data)
+	} else {
+		talosConfig, err = talosconfig.Open("")
+	}
+
+	if err != nil {
+		return serviceConfig, service.Result{}, fmt.Errorf("failed to get talosconfig: %w", err)
+	}
+
+	talosClient, err := talosclient.New(ctx,
+		talosclient.WithConfig(talosConfig),
+		talosclient.WithGRPCDialOptions(grpc.WithStatsHandler(otelgrpc.NewClientHandler())),
+	)
+	if err != nil {
+		return serviceConfig, service.Result{}, fmt.Errorf("failed to create talos client: %w", err)
+	}
+
+	defer talosClient.Close() //nolint:errcheck
+
+	result, err := service.BackupSnapshotWithResult(ctx, serviceConfig, talosConfig, talosClient, serviceConfig.EnableCompression, serviceConfig.DisableEncryption)
+
+	return serviceConfig, result, err
+}
+
+// backupConfig returns the controller's service config with the settings of schedule applied.
+func (c *controller) backupConfig(ctx context.Context, schedule *EtcdBackupSchedule) (*config.ServiceConfig, error) {
+	spec := schedule.Spec
+	serviceConfig := *c.serviceConfig.Get()
+
+	// backups are recorded on EtcdBackup resources rather than as Events on the controller pod
+	serviceConfig.Kubernetes = config.KubernetesConfig{}
+
+	serviceConfig.Bucket = spec.Destination.Bucket
+	serviceConfig.S3Prefix = spec.Destination.Prefix
+	serviceConfig.ClusterName = spec.ClusterName
+	serviceConfig.EnableCompression = spec.Compression
+	serviceConfig.DisableEncryption = spec.Encryption.Disabled
+
+	// the region of the destination takes precedence over S3_REGION as well
+	if spec.Destination.Region != "" {
+		serviceConfig.Region = spec.Destination.Region
+		serviceConfig.S3Endpoint.Region = spec.Destination.Region
+	}
+
+	if spec.Destination.Endpoint != "" {
+		serviceConfig.CustomS3Endpoint = spec.Destination.Endpoint
+	}
+
+	if ref := spec.Encryption.RecipientSecretRef; ref != nil {
+		recipient, err := c.secretValue(ctx, *ref)
+		if err != nil {
+			return &serviceConfig, err
+		}
+
+		serviceConfig.AgeX25519PublicKey = strings.TrimSpace(string(recipient))
+	}
+
+	if !serviceConfig.DisableEncryption && serviceConfig.AgeX25519PublicKey == "" {
+		return &serviceConfig, errors.New("encryption is enabled but no recipient is configured")
+	}
+
+	return &serviceConfig, nil
+}
+
+func (c *controller) secretValue(ctx context.Context, ref SecretKeySelector) ([]byte, error) {
+	secret, err := c.clientset.CoreV1().Secrets(c.namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s: %w", ref.Name, err)
+	}
+
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no key %q", ref.Name, ref.Key)
+	}
+
+	return value, nil
+}
+
+// destinationOf returns the S3 destination of serviceConfig.
+func destinationOf(serviceConfig *config.ServiceConfig) *Destination {
+	region := serviceConfig.S3Endpoint.Region
+	if region == "" {
+		region = serviceConfig.Region
+	}
+
+	return &Destination{
+		Bucket:   serviceConfig.Bucket,
+		Region:   region,
+		Prefix:   serviceConfig.S3Prefix,
+		Endpoint: serviceConfig.CustomS3Endpoint,
+	}
+}
+
+// storageConfig returns serviceConfig with the S3 destination the artifacts of backup were uploaded to.
+//
+// Backups recorded by older versions only record the bucket, the current endpoint and region of the schedule are assumed for them.
+func storageConfig(serviceConfig *config.ServiceConfig, backup *EtcdBackup) *config.ServiceConfig {
+	storageConfig := *serviceConfig
+	storageConfig.Bucket = backup.Status.Bucket
+
+	if storage := backup.Status.Storage; storage != nil {
+		storageConfig.Bucket = storage.Bucket
+		storageConfig.Region = storage.Region
+		storageConfig.S3Endpoint.Region = storage.Region
+		storageConfig.CustomS3Endpoint = storage.Endpoint
+	}
+
+	return &storageConfig
+}
+
+// pruneCandidates returns the backups beyond the keep most recent successful and keep most recent failed or skipped backups,
+// ignoring running backups.
+func pruneCandidates(backups []*EtcdBackup, keep int) []*EtcdBackup {
+	backups = slices.Clone(backups)
+
+	// newest first
+	slices.SortStableFunc(backups, func(a, b *EtcdBackup) int {
+		return b.CreationTimestamp.Compare(a.CreationTimestamp.Time)
+	})
+
+	var (
+		candidates        []*EtcdBackup
+		succeeded, failed int
+	)
+
+	for _, backup := range backups {
+		switch backup.Status.Phase {
+		case PhaseSucceeded:
+			if succeeded++; succeeded <= keep {
+				continue
+			}
+		case PhaseFailed, PhaseSkipped:
+			if failed++; failed <= keep {
+				continue
+			}
+		default:
+			continue
+		}
+
+		candidates = append(candidates, backup)
+	}
+
+	return candidates
+}
+
+// prune deletes the successful backups of schedule beyond its retention and as many failed or skipped backups,
+// along with all artifacts they uploaded.
+func (c *controller) prune(ctx context.Context, schedule *EtcdBackupSchedule, serviceConfig *config.ServiceConfig) error {
+	keep := schedule.Spec.Retention.Keep
+	if keep <= 0 {
+		return nil
+	}
+
+	list, err := c.dynamicClient.Resource(backupResource).Namespace(c.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: LabelSchedule + "=" + schedule.Name,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	backups := make([]*EtcdBackup, 0, len(list.Items))
+
+	for i := range list.Items {
+		backup, decodeErr := fromUnstructured[EtcdBackup](&list.Items[i])
+		if decodeErr != nil {
+			return fmt.Errorf("failed to decode backup: %w", decodeErr)
+		}
+
+		backups = append(backups, backup)
+	}
+
+	// S3 clients by endpoint and region
+	s3Clients := map[Destination]*minio.Client{}
+
+	for _, backup := range pruneCandidates(backups, keep) {
+		keys := backup.Status.ObjectKeys
+
+		// backups recorded by older versions only have the key of the snapshot
+		if len(keys) == 0 && backup.Status.ObjectKey != "" {
+			keys = []string{backup.Status.ObjectKey}
+		}
+
+		if len(keys) > 0 {
+			backupConfig := storageConfig(serviceConfig, backup)
+			clientKey := Destination{Region: backupConfig.S3Endpoint.Region, Endpoint: backupConfig.CustomS3Endpoint}
+
+			s3Client := s3Clients[clientKey]
+			if s3Client == nil {
+				if s3Client, err = s3.CreateClientWithCustomEndpoint(ctx, backupConfig); err != nil {
+					return fmt.Errorf("failed to create S3 client: %w", err)
+				}
+
+				s3Clients[clientKey] = s3Client
+			}
+
+			for _, key := range keys {
+				if err = s3Client.RemoveObject(ctx, backupConfig.Bucket, key, minio.RemoveObjectOptions{}); err != nil {
+					return fmt.Errorf("failed to delete %s: %w", key, err)
+				}
+			}
+		}
+
+		if err = c.dynamicClient.Resource(backupResource).Namespace(c.namespace).Delete(ctx, backup.Name, metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("failed to delete backup %s: %w", backup.Name, err)
+		}
+
+		logging.FromContext(ctx).Info("pruned backup", "backup", backup.Name, logging.KeyObjectKey, backup.Status.ObjectKey)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+)
+
+func testBackup(name, phase string, created time.Time) *EtcdBackup {
+	return &EtcdBackup{
+		TypeMeta: metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: "EtcdBackup"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         testNamespace,
+			CreationTimestamp: metav1.Time{Time: created},
+			Labels:            map[string]string{LabelSchedule: "hourly"},
+		},
+		Spec:   EtcdBackupSpec{Schedule: "hourly"},
+		Status: EtcdBackupStatus{Phase: phase},
+	}
+}
+
+func backupNames(backups []*EtcdBackup) []string {
+	names := make([]string, 0, len(backups))
+
+	for _, backup := range backups {
+		names = append(names, backup.Name)
+	}
+
+	return names
+}
+
+func TestPruneCandidates(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// deliberately out of order
+	backups := []*EtcdBackup{
+		testBackup("succeeded-2", PhaseSucceeded, start.Add(2*time.Hour)),
+		testBackup("failed-1", PhaseFailed, start.Add(1*time.Hour)),
+		testBackup("succeeded-5", PhaseSucceeded, start.Add(5*time.Hour)),
+		testBackup("running-7", PhaseRunning, start.Add(7*time.Hour)),
+		testBackup("succeeded-0", PhaseSucceeded, start),
+		testBackup("skipped-3", PhaseSkipped, start.Add(3*time.Hour)),
+		testBackup("failed-6", PhaseFailed, start.Add(6*time.Hour)),
+		testBackup("succeeded-4", PhaseSucceeded, start.Add(4*time.Hour)),
+		testBackup("running-8", "", start.Add(8*time.Hour)),
+	}
+
+	for _, test := range []struct {
+		name     string
+		expected []string
+		keep     int
+	}{
+		{
+			name:     "keep 1",
+			keep:     1,
+			expected: []string{"succeeded-4", "skipped-3", "succeeded-2", "failed-1", "succeeded-0"},
+		},
+		{
+			name:     "keep 2",
+			keep:     2,
+			expected: []string{"succeeded-2", "failed-1", "succeeded-0"},
+		},
+		{
+			name:     "keep 4",
+			keep:     4,
+			expected: []string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, backupNames(pruneCandidates(backups, test.keep)))
+		})
+	}
+
+	// the input is left in order
+	assert.Equal(t, "succeeded-2", backups[0].Name)
+}
+
+func TestStorageConfig(t *testing.T) {
+	t.Parallel()
+
+	serviceConfig := &config.ServiceConfig{
+		Bucket:           "current",
+		Region:           "us-east-1",
+		S3Prefix:         "cluster",
+		CustomS3Endpoint: "https://current.example.com",
+		S3Endpoint:       config.S3EndpointConfig{Region: "garage", BucketLookup: "path"},
+	}
+
+	assert.Equal(t, &Destination{
+		Bucket:   "current",
+		Region:   "garage",
+		Prefix:   "cluster",
+		Endpoint: "https://current.example.com",
+	}, destinationOf(serviceConfig))
+
+	for _, test := range []struct {
+		storage          *Destination
+		name             string
+		bucket           string
+		expectedBucket   string
+		expectedRegion   string
+		expectedEndpoint string
+	}{
+		{
+			name:             "recorded",
+			bucket:           "previous",
+			storage:          &Destination{Bucket: "previous", Region: "eu-west-1", Prefix: "old"},
+			expectedBucket:   "previous",
+			expectedRegion:   "eu-west-1",
+			expectedEndpoint: "",
+		},
+		{
+			name:             "recorded endpoint",
+			bucket:           "previous",
+			storage:          &Destination{Bucket: "previous", Region: "minio", Endpoint: "https://previous.example.com"},
+			expectedBucket:   "previous",
+			expectedRegion:   "minio",
+			expectedEndpoint: "https://previous.example.com",
+		},
+		{
+			name:             "legacy",
+			bucket:           "previous",
+			expectedBucket:   "previous",
+			expectedRegion:   "garage",
+			expectedEndpoint: "https://current.example.com",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			backup := testBackup("backup", PhaseSucceeded, time.Now())
+			backup.Status.Bucket = test.bucket
+			backup.Status.Storage = test.storage
+
+			storageConfig := storageConfig(serviceConfig, backup)
+
+			assert.Equal(t, test.expectedBucket, storageConfig.Bucket)
+			assert.Equal(t, test.expectedRegion, storageConfig.S3Endpoint.Region)
+			assert.Equal(t, test.expectedEndpoint, storageConfig.CustomS3Endpoint)
+			assert.Equal(t, "path", storageConfig.S3Endpoint.BucketLookup)
+
+			// the service config is left as is
+			assert.Equal(t, "current", serviceConfig.Bucket)
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	backups := []*EtcdBackup{
+		testBackup("succeeded-0", PhaseSucceeded, start),
+		testBackup("failed-1", PhaseFailed, start.Add(time.Hour)),
+		testBackup("succeeded-2", PhaseSucceeded, start.Add(2*time.Hour)),
+		testBackup("failed-3", PhaseFailed, start.Add(3*time.Hour)),
+		testBackup("running-4", PhaseRunning, start.Add(4*time.Hour)),
+	}
+
+	other := testBackup("other", PhaseSucceeded, start)
+	other.Labels[LabelSchedule] = "daily"
+
+	schedule := testSchedule("hourly", "0 * * * *", start)
+	schedule.Spec.Retention.Keep = 1
+
+	c, _ := testController(t,
+		toUnstructured(t, backups[0]), toUnstructured(t, backups[1]), toUnstructured(t, backups[2]),
+		toUnstructured(t, backups[3]), toUnstructured(t, backups[4]), toUnstructured(t, other),
+	)
+
+	// none of the backups uploaded artifacts, so no S3 client is needed
+	require.NoError(t, c.prune(t.Context(), schedule, &config.ServiceConfig{}))
+
+	list, err := c.dynamicClient.Resource(backupResource).Namespace(testNamespace).List(t.Context(), metav1.ListOptions{})
+	require.NoError(t, err)
+
+	var remaining []string
+
+	for _, item := range list.Items {
+		remaining = append(remaining, item.GetName())
+	}
+
+	assert.ElementsMatch(t, []string{"succeeded-2", "failed-3", "running-4", "other"}, remaining)
+}
@@ -0,0 +1,314 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package controller reconciles EtcdBackupSchedule custom resources into backups.
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+const (
+	leaseName     = "talos-backup-controller"
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+
+	// maxWait bounds the time between reconciliations, so that clock jumps can't delay backups indefinitely.
+	maxWait = 5 * time.Minute
+)
+
+// controller runs the backups of the EtcdBackupSchedules in a single namespace.
+type controller struct {
+	serviceConfig *config.Reloader
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	schedules     cache.Store
+	// startBackup runs a backup of a schedule which is due, c.backup unless replaced in tests.
+	startBackup func(context.Context, *EtcdBackupSchedule)
+	wakeup      chan struct{}
+	running     map[string]struct{}
+	// scheduled holds the last schedule time of each schedule, as the informer cache may lag behind its status.
+	scheduled map[string]time.Time
+	namespace string
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+}
+
+// Run runs the controller in the namespace talos-backup runs in until ctx is canceled or leadership is lost.
+//
+// Only the replica holding the leader election lease runs backups.
+func Run(ctx context.Context, serviceConfig *config.ServiceConfig) error {
+	namespace := serviceConfig.Kubernetes.Namespace
+	if namespace == "" {
+		return errors.New("the controller requires the POD_NAMESPACE environment variable")
+	}
+
+	identity := serviceConfig.Kubernetes.PodName
+	if identity == "" {
+		var err error
+
+		if identity, err = os.Hostname(); err != nil {
+			return fmt.Errorf("failed to get hostname: %w", err)
+		}
+	}
+
+	// falls back to the in-cluster config if KUBECONFIG is not set
+	restConfig, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return fmt.Errorf("failed to load Kubernetes config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	c := &controller{
+		serviceConfig: config.NewReloader(serviceConfig),
+		clientset:     clientset,
+		dynamicClient: dynamicClient,
+		wakeup:        make(chan struct{}, 1),
+		running:       map[string]struct{}{},
+		scheduled:     map[string]time.Time{},
+		namespace:     namespace,
+	}
+
+	c.startBackup = c.backup
+
+	logger := logging.FromContext(ctx)
+
+	go c.serviceConfig.Run(ctx)
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: leaseName, Namespace: namespace},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            leaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logger.Info("started leading", "identity", identity)
+
+				c.run(ctx)
+			},
+			OnStoppedLeading: func() {
+				logger.Info("stopped leading", "identity", identity)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create leader elector: %w", err)
+	}
+
+	elector.Run(ctx)
+
+	if ctx.Err() == nil {
+		return errors.New("lost leadership")
+	}
+
+	return nil
+}
+
+// run reconciles the schedules until ctx is canceled, then waits for running backups to finish.
+func (c *controller) run(ctx context.Context) {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.dynamicClient, maxWait, c.namespace, nil)
+	informer := factory.ForResource(scheduleResource).Informer()
+	c.schedules = informer.GetStore()
+
+	trigger := func(any) { c.trigger() }
+
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    trigger,
+		UpdateFunc: func(any, any) { c.trigger() },
+		DeleteFunc: trigger,
+	}); err != nil {
+		logging.FromContext(ctx).Error("failed to watch backup schedules", logging.Error(err))
+
+		return
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(c.reconcile(ctx, time.Now())))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			c.wg.Wait()
+
+			return
+		case <-c.wakeup:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *controller) trigger() {
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// reconcile starts the backups which are due, returning the time of the next one.
+func (c *controller) reconcile(ctx context.Context, now time.Time) time.Time {
+	next := now.Add(maxWait)
+
+	for _, obj := range c.schedules.List() {
+		schedule, err := fromUnstructured[EtcdBackupSchedule](obj)
+		if err != nil {
+			logging.FromContext(ctx).Error("failed to decode backup schedule", logging.Error(err))
+
+			continue
+		}
+
+		logger := logging.FromContext(ctx).With("schedule", schedule.Name)
+
+		if schedule.Spec.Suspend {
+			continue
+		}
+
+		cronSchedule, err := cron.ParseStandard(schedule.Spec.Schedule)
+		if err != nil {
+			logger.Error("invalid backup schedule", logging.Error(err))
+
+			continue
+		}
+
+		last := schedule.CreationTimestamp.Time
+		if schedule.Status.LastScheduleTime != nil {
+			last = schedule.Status.LastScheduleTime.Time
+		}
+
+		if scheduled := c.scheduled[schedule.Name]; scheduled.After(last) {
+			last = scheduled
+		}
+
+		due := cronSchedule.Next(last)
+		if due.After(now) {
+			if due.Before(next) {
+				next = due
+			}
+
+			continue
+		}
+
+		c.scheduled[schedule.Name] = now
+
+		if due = cronSchedule.Next(now); due.Before(next) {
+			next = due
+		}
+
+		if !c.start(schedule.Name) {
+			logger.Warn("previous backup is still running, skipping")
+
+			continue
+		}
+
+		if err = c.patchStatus(ctx, scheduleResource, schedule.Name, EtcdBackupScheduleStatus{LastScheduleTime: &metav1.Time{Time: now}}); err != nil {
+			logger.Warn("failed to update backup schedule status", logging.Error(err))
+		}
+
+		c.wg.Add(1)
+
+		go func() {
+			defer c.wg.Done()
+			defer c.finish(schedule.Name)
+
+			c.startBackup(logging.WithLogger(ctx, logger), schedule)
+		}()
+	}
+
+	return next
+}
+
+// start marks the backup of schedule as running, returning false if it already is.
+func (c *controller) start(schedule string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, running := c.running[schedule]; running {
+		return false
+	}
+
+	c.running[schedule] = struct{}{}
+
+	return true
+}
+
+func (c *controller) finish(schedule string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.running, schedule)
+}
+
+// patchStatus merges status into the status of the resource name.
+func (c *controller) patchStatus(ctx context.Context, resource schema.GroupVersionResource, name string, status any) error {
+	patch, err := json.Marshal(map[string]any{"status": status})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.dynamicClient.Resource(resource).Namespace(c.namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+
+	return err
+}
+
+func fromUnstructured[T any](obj any) (*T, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+
+	var t T
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
@@ -0,0 +1,213 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testNamespace = "talos-backup"
+
+func toUnstructured(t *testing.T, obj any) *unstructured.Unstructured {
+	t.Helper()
+
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	require.NoError(t, err)
+
+	return &unstructured.Unstructured{Object: u}
+}
+
+func testSchedule(name, schedule string, created time.Time) *EtcdBackupSchedule {
+	return &EtcdBackupSchedule{
+		TypeMeta: metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: "EtcdBackupSchedule"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         testNamespace,
+			CreationTimestamp: metav1.Time{Time: created},
+		},
+		Spec: EtcdBackupScheduleSpec{Schedule: schedule},
+	}
+}
+
+// testController returns a controller over objects, sending the names of the schedules it starts backups of to started.
+func testController(t *testing.T, objects ...*unstructured.Unstructured) (*controller, chan string) {
+	t.Helper()
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	runtimeObjects := make([]runtime.Object, 0, len(objects))
+
+	for _, obj := range objects {
+		require.NoError(t, store.Add(obj))
+
+		runtimeObjects = append(runtimeObjects, obj)
+	}
+
+	started := make(chan string, len(objects)+1)
+
+	c := &controller{
+		dynamicClient: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+			scheduleResource: "EtcdBackupScheduleList",
+			backupResource:   "EtcdBackupList",
+		}, runtimeObjects...),
+		schedules: store,
+		startBackup: func(_ context.Context, schedule *EtcdBackupSchedule) {
+			started <- schedule.Name
+		},
+		wakeup:    make(chan struct{}, 1),
+		running:   map[string]struct{}{},
+		scheduled: map[string]time.Time{},
+		namespace: testNamespace,
+	}
+
+	return c, started
+}
+
+func startedBackups(c *controller, started chan string) []string {
+	c.wg.Wait()
+
+	var names []string
+
+	for {
+		select {
+		case name := <-started:
+			names = append(names, name)
+		default:
+			return names
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 1, 10, 58, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		schedule *EtcdBackupSchedule
+		name     string
+		next     time.Time
+		started  bool
+	}{
+		{
+			name:     "due",
+			schedule: testSchedule("hourly", "0 * * * *", now.Add(-90*time.Minute)),
+			next:     time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC),
+			started:  true,
+		},
+		{
+			name:     "not due",
+			schedule: testSchedule("hourly", "0 * * * *", now.Add(-20*time.Minute)),
+			next:     time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "scheduled",
+			schedule: func() *EtcdBackupSchedule {
+				schedule := testSchedule("hourly", "0 * * * *", now.Add(-24*time.Hour))
+				schedule.Status.LastScheduleTime = &metav1.Time{Time: now.Add(-25 * time.Minute)}
+
+				return schedule
+			}(),
+			next: time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "bounded wait",
+			schedule: testSchedule("daily", "0 0 * * *", now.Add(-time.Hour)),
+			next:     now.Add(maxWait),
+		},
+		{
+			name: "suspended",
+			schedule: func() *EtcdBackupSchedule {
+				schedule := testSchedule("hourly", "0 * * * *", now.Add(-90*time.Minute))
+				schedule.Spec.Suspend = true
+
+				return schedule
+			}(),
+			next: now.Add(maxWait),
+		},
+		{
+			name:     "invalid schedule",
+			schedule: testSchedule("invalid", "every hour", now.Add(-90*time.Minute)),
+			next:     now.Add(maxWait),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, started := testController(t, toUnstructured(t, test.schedule))
+
+			assert.WithinDuration(t, test.next, c.reconcile(t.Context(), now), 0)
+
+			obj, err := c.dynamicClient.Resource(scheduleResource).Namespace(testNamespace).Get(t.Context(), test.schedule.Name, metav1.GetOptions{})
+			require.NoError(t, err)
+
+			schedule, err := fromUnstructured[EtcdBackupSchedule](obj)
+			require.NoError(t, err)
+
+			if !test.started {
+				assert.Empty(t, startedBackups(c, started))
+
+				if test.schedule.Status.LastScheduleTime == nil {
+					assert.Nil(t, schedule.Status.LastScheduleTime)
+				} else {
+					assert.WithinDuration(t, test.schedule.Status.LastScheduleTime.Time, schedule.Status.LastScheduleTime.Time, 0)
+				}
+
+				return
+			}
+
+			assert.Equal(t, []string{test.schedule.Name}, startedBackups(c, started))
+			require.NotNil(t, schedule.Status.LastScheduleTime)
+			assert.WithinDuration(t, now, schedule.Status.LastScheduleTime.Time, 0)
+		})
+	}
+}
+
+func TestReconcileOnce(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 1, 10, 30, 0, 0, time.UTC)
+
+	c, started := testController(t, toUnstructured(t, testSchedule("hourly", "0 * * * *", now.Add(-90*time.Minute))))
+
+	var release sync.WaitGroup
+
+	release.Add(1)
+
+	startBackup := c.startBackup
+	c.startBackup = func(ctx context.Context, schedule *EtcdBackupSchedule) {
+		startBackup(ctx, schedule)
+
+		release.Wait()
+	}
+
+	c.reconcile(t.Context(), now)
+
+	// the store still holds the schedule without its last schedule time
+	c.reconcile(t.Context(), now.Add(time.Minute))
+
+	// the next backup is due while the first one is still running
+	c.reconcile(t.Context(), now.Add(time.Hour))
+
+	release.Done()
+
+	assert.Equal(t, []string{"hourly"}, startedBackups(c, started))
+
+	// the next backup starts once the first one finished
+	c.reconcile(t.Context(), now.Add(2*time.Hour))
+
+	assert.Equal(t, []string{"hourly"}, startedBackups(c, started))
+}
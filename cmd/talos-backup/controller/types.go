@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// API group and version of the custom resources.
+const (
+	Group   = "talos-backup.siderolabs.com"
+	Version = "v1alpha1"
+)
+
+var (
+	scheduleResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "etcdbackupschedules"}
+	backupResource   = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "etcdbackups"}
+)
+
+// LabelSchedule is the label carrying the name of the EtcdBackupSchedule an EtcdBackup was created for.
+const LabelSchedule = Group + "/schedule"
+
+// EtcdBackup phases.
+const (
+	PhaseRunning   = "Running"
+	PhaseSucceeded = "Succeeded"
+	PhaseFailed    = "Failed"
+	PhaseSkipped   = "Skipped"
+)
+
+// EtcdBackup condition types.
+const (
+	ConditionComplete = "Complete"
+	ConditionFailed   = "Failed"
+	ConditionSkipped  = "Skipped"
+)
+
+// EtcdBackupSchedule schedules backups of a Talos cluster.
+type EtcdBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EtcdBackupScheduleSpec   `json:"spec"`
+	Status EtcdBackupScheduleStatus `json:"status,omitempty"`
+}
+
+// EtcdBackupScheduleSpec describes when and where to back up a Talos cluster.
+type EtcdBackupScheduleSpec struct {
+	// Schedule is a standard cron expression.
+	Schedule string `json:"schedule"`
+	// ClusterName defaults to the name of the talosconfig context.
+	ClusterName string `json:"clusterName,omitempty"`
+	// TalosConfigSecretRef references the talosconfig to use, the controller's own talosconfig is used if it is not set.
+	TalosConfigSecretRef *SecretKeySelector `json:"talosConfigSecretRef,omitempty"`
+	Destination          Destination        `json:"destination"`
+	Encryption           Encryption         `json:"encryption,omitempty"`
+	Retention            Retention          `json:"retention,omitempty"`
+	Suspend              bool               `json:"suspend,omitempty"`
+	Compression          bool               `json:"compression,omitempty"`
+}
+
+// Destination is the S3 bucket backups are uploaded to.
+type Destination struct {
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// Encryption configures the encryption of backups.
+type Encryption struct {
+	// RecipientSecretRef references the age X25519 public key backups are encrypted to.
+	RecipientSecretRef *SecretKeySelector `json:"recipientSecretRef,omitempty"`
+	Disabled           bool               `json:"disabled,omitempty"`
+}
+
+// Retention configures how many backups are kept.
+type Retention struct {
+	// Keep is the number of successful backups to keep, older ones are deleted from the bucket.
+	// All backups are kept if it is zero.
+	Keep int `json:"keep,omitempty"`
+}
+
+// SecretKeySelector selects a key of a Secret in the namespace of the EtcdBackupSchedule.
+type SecretKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// EtcdBackupScheduleStatus is the observed state of an EtcdBackupSchedule.
+type EtcdBackupScheduleStatus struct {
+	LastScheduleTime   *metav1.Time `json:"lastScheduleTime,omitempty"`
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	LastBackup         string       `json:"lastBackup,omitempty"`
+}
+
+// EtcdBackup records a single backup run.
+type EtcdBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EtcdBackupSpec   `json:"spec"`
+	Status EtcdBackupStatus `json:"status,omitempty"`
+}
+
+// EtcdBackupSpec references the schedule which created the backup.
+type EtcdBackupSpec struct {
+	Schedule string `json:"schedule"`
+}
+
+// EtcdBackupStatus is the outcome of a backup run.
+type EtcdBackupStatus struct {
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	Phase          string       `json:"phase,omitempty"`
+	Bucket         string       `json:"bucket,omitempty"`
+	ObjectKey      string       `json:"objectKey,omitempty"`
+	// Storage is the destination the artifacts were uploaded to, with the effective region, to delete them from when pruned
+	// even if the destination of the schedule changed since.
+	Storage *Destination `json:"storage,omitempty"`
+	// ObjectKeys are the keys of all artifacts uploaded by the backup, deleted along with it when pruned.
+	ObjectKeys []string           `json:"objectKeys,omitempty"`
+	Duration   string             `json:"duration,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	Size       int64              `json:"size,omitempty"`
+}
@@ -8,27 +8,90 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
 	talosconfig "github.com/siderolabs/talos/pkg/machinery/client/config"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
 
+	"github.com/siderolabs/talos-backup/cmd/talos-backup/controller"
+	"github.com/siderolabs/talos-backup/cmd/talos-backup/server"
 	"github.com/siderolabs/talos-backup/cmd/talos-backup/service"
 	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+	"github.com/siderolabs/talos-backup/pkg/metrics"
+	"github.com/siderolabs/talos-backup/pkg/tracing"
 )
 
-func run() error {
-	ctx := context.Background()
+func run(args []string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	serviceConfig := config.GetServiceConfig()
+	serviceConfig, err := config.GetServiceConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get service config: %w", err)
+	}
+
+	logger, err := logging.New(os.Stderr, serviceConfig.LogFormat, serviceConfig.LogLevel)
+	if err != nil {
+		return fmt.Errorf("failed to create logger: %w", err)
+	}
+
+	slog.SetDefault(logger)
+
+	ctx = logging.WithLogger(ctx, logger)
+
+	if serviceConfig.MetricsAddress != "" {
+		go func() {
+			if serveErr := metrics.Serve(ctx, serviceConfig.MetricsAddress); serveErr != nil {
+				logger.Error("metrics server failed", logging.Error(serveErr))
+			}
+		}()
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	defer func() {
+		if shutdownErr := shutdownTracing(context.WithoutCancel(ctx)); shutdownErr != nil {
+			logger.Error("failed to shut down tracing", logging.Error(shutdownErr))
+		}
+	}()
+
+	command := "backup"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "backup":
+		return backup(ctx, serviceConfig)
+	case "controller":
+		return controller.Run(ctx, serviceConfig)
+	case "server":
+		return server.Run(ctx, serviceConfig)
+	default:
+		return fmt.Errorf("unknown command %q, expected backup, controller or server", command)
+	}
+}
 
+// backup takes a single backup.
+func backup(ctx context.Context, serviceConfig *config.ServiceConfig) error {
 	talosConfig, err := talosconfig.Open("")
 	if err != nil {
 		return fmt.Errorf("failed to get talosconfig: %w", err)
 	}
 
-	talosClient, err := talosclient.New(ctx, talosclient.WithConfig(talosConfig))
+	talosClient, err := talosclient.New(ctx,
+		talosclient.WithConfig(talosConfig),
+		talosclient.WithGRPCDialOptions(grpc.WithStatsHandler(otelgrpc.NewClientHandler())),
+	)
 	if err != nil {
 		return fmt.Errorf("failed to create talos client: %w", err)
 	}
@@ -37,8 +100,8 @@ func run() error {
 }
 
 func main() {
-	if err := run(); err != nil {
-		log.Println(err)
+	if err := run(os.Args[1:]); err != nil {
+		slog.Error("talos-backup failed", logging.Error(err))
 
 		os.Exit(-1)
 	}
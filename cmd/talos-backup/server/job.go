@@ -0,0 +1,147 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped"
+)
+
+// maxProgress is the number of most recent progress records kept for each job.
+const maxProgress = 1000
+
+// Progress is a log record of a running backup.
+type Progress struct {
+	Time    time.Time      `json:"time"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+	Level   string         `json:"level"`
+	Message string         `json:"message"`
+}
+
+// JobStatus is the state of a backup job as returned by the API.
+type JobStatus struct {
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	ID         string     `json:"id"`
+	Cluster    string     `json:"cluster"`
+	Status     string     `json:"status"`
+	ObjectKey  string     `json:"objectKey,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	// Progress holds the most recent progress records, after DroppedProgress older ones.
+	Progress        []Progress `json:"progress,omitempty"`
+	DroppedProgress int        `json:"droppedProgress,omitempty"`
+	Size            int64      `json:"size,omitempty"`
+}
+
+// job is a backup triggered via the API.
+type job struct {
+	// changed is closed and replaced whenever progress is recorded or the job finishes.
+	changed chan struct{}
+	status  JobStatus
+	mu      sync.Mutex
+}
+
+func newJob(id, cluster string) *job {
+	return &job{
+		changed: make(chan struct{}),
+		status: JobStatus{
+			ID:        id,
+			Cluster:   cluster,
+			Status:    StatusRunning,
+			StartedAt: time.Now(),
+		},
+	}
+}
+
+// snapshot returns a copy of the job status and a channel closed on its next change.
+func (j *job) snapshot() (JobStatus, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := j.status
+	status.Progress = slices.Clone(status.Progress)
+
+	return status, j.changed
+}
+
+func (j *job) update(f func(*JobStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f(&j.status)
+
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// progressHandler records the log records of a job as its progress before passing them on.
+type progressHandler struct {
+	slog.Handler
+
+	job   *job
+	attrs []slog.Attr
+}
+
+func (h *progressHandler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := make(map[string]any, len(h.attrs)+r.NumAttrs())
+
+	for _, attr := range h.attrs {
+		attrs[attr.Key] = attr.Value.Resolve().Any()
+	}
+
+	r.Attrs(func(attr slog.Attr) bool {
+		value := attr.Value.Resolve().Any()
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		attrs[attr.Key] = value
+
+		return true
+	})
+
+	h.job.update(func(status *JobStatus) {
+		status.Progress = append(status.Progress, Progress{
+			Time:    r.Time,
+			Level:   r.Level.String(),
+			Message: r.Message,
+			Attrs:   attrs,
+		})
+
+		if dropped := len(status.Progress) - maxProgress; dropped > 0 {
+			status.Progress = status.Progress[dropped:]
+			status.DroppedProgress += dropped
+		}
+	})
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *progressHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &progressHandler{
+		Handler: h.Handler.WithAttrs(attrs),
+		job:     h.job,
+		attrs:   append(slices.Clip(h.attrs), attrs...),
+	}
+}
+
+func (h *progressHandler) WithGroup(name string) slog.Handler {
+	return &progressHandler{
+		Handler: h.Handler.WithGroup(name),
+		job:     h.job,
+		attrs:   h.attrs,
+	}
+}
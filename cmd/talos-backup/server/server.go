@@ -0,0 +1,360 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package server provides an HTTP API triggering backups on demand.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+	talosconfig "github.com/siderolabs/talos/pkg/machinery/client/config"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+
+	"github.com/siderolabs/talos-backup/cmd/talos-backup/service"
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+const (
+	// maxFinishedJobs is the number of finished jobs kept for polling.
+	maxFinishedJobs = 100
+	shutdownTimeout = 10 * time.Second
+)
+
+// BackupRequest is the optional body of a backup request.
+type BackupRequest struct {
+	// Context selects the talosconfig context, and so the cluster, to back up.
+	Context string `json:"context,omitempty"`
+}
+
+type server struct {
+	serviceConfig *config.Reloader
+	jobs          map[string]*job
+	// running maps cluster names to the ID of their running job.
+	running map[string]string
+	// finished holds the IDs of finished jobs, oldest first.
+	finished []string
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+// Run serves the backup API until ctx is canceled, then waits for running backups to finish.
+//
+// POST /v1/backups starts a backup and returns its job, GET /v1/backups/{id} returns the job
+// and GET /v1/backups/{id}/events streams its progress as newline delimited JSON until it finishes.
+func Run(ctx context.Context, serviceConfig *config.ServiceConfig) error {
+	if serviceConfig.Server.Token == "" {
+		return errors.New("the server requires the SERVER_TOKEN environment variable")
+	}
+
+	s := newServer(serviceConfig)
+
+	srv := &http.Server{
+		Addr:              serviceConfig.Server.Address,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	go s.serviceConfig.Run(ctx)
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+
+		srv.Shutdown(shutdownCtx) //nolint:errcheck
+	}()
+
+	logging.FromContext(ctx).Info("serving backup API", "address", serviceConfig.Server.Address)
+
+	err := srv.ListenAndServe()
+
+	s.wg.Wait()
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve backup API: %w", err)
+	}
+
+	return nil
+}
+
+func newServer(serviceConfig *config.ServiceConfig) *server {
+	return &server{
+		serviceConfig: config.NewReloader(serviceConfig),
+		jobs:          map[string]*job{},
+		running:       map[string]string{},
+	}
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/backups", s.handleCreate)
+	mux.HandleFunc("GET /v1/backups/{id}", s.handleGet)
+	mux.HandleFunc("GET /v1/backups/{id}/events", s.handleEvents)
+
+	return s.authenticate(mux)
+}
+
+// authenticate rejects requests without the configured bearer token.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the token may have been emptied by a reload, which must not let requests without a token through
+		expected := s.serviceConfig.Get().Server.Token
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req BackupRequest
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+
+			return
+		}
+	}
+
+	talosConfig, err := talosconfig.Open("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get talosconfig: %w", err))
+
+		return
+	}
+
+	serviceConfig := *s.serviceConfig.Get()
+
+	if req.Context != "" {
+		if _, ok := talosConfig.Contexts[req.Context]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown context %q", req.Context))
+
+			return
+		}
+
+		talosConfig.Context = req.Context
+		serviceConfig.ClusterName = req.Context
+	}
+
+	cluster := serviceConfig.ClusterName
+	if cluster == "" {
+		cluster = talosConfig.Context
+	}
+
+	j, existing, err := s.startJob(cluster)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	if existing {
+		status, _ := j.snapshot()
+
+		writeJSON(w, http.StatusConflict, status)
+
+		return
+	}
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		s.backup(r.Context(), j, &serviceConfig, talosConfig)
+	}()
+
+	status, _ := j.snapshot()
+
+	w.Header().Set("Location", "/v1/backups/"+status.ID)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// startJob registers a new job for cluster, or returns its running job, if there is one.
+func (s *server) startJob(cluster string) (*job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.running[cluster]; ok {
+		return s.jobs[id], true, nil
+	}
+
+	idBytes := make([]byte, 16)
+
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, false, fmt.Errorf("failed to generate job ID: %w", err)
+	}
+
+	j := newJob(hex.EncodeToString(idBytes), cluster)
+
+	s.jobs[j.status.ID] = j
+	s.running[cluster] = j.status.ID
+
+	return j, false, nil
+}
+
+func (s *server) finishJob(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.running, j.status.Cluster)
+
+	s.finished = append(s.finished, j.status.ID)
+
+	for len(s.finished) > maxFinishedJobs {
+		delete(s.jobs, s.finished[0])
+
+		s.finished = s.finished[1:]
+	}
+}
+
+// backup runs the backup of job j, detached from the request which started it.
+func (s *server) backup(ctx context.Context, j *job, serviceConfig *config.ServiceConfig, talosConfig *talosconfig.Config) {
+	defer s.finishJob(j)
+
+	logger := logging.FromContext(ctx)
+	ctx = logging.WithLogger(context.WithoutCancel(ctx), slog.New(&progressHandler{Handler: logger.Handler(), job: j}).With("job", j.status.ID))
+
+	result, err := s.runBackup(ctx, serviceConfig, talosConfig)
+
+	j.update(func(status *JobStatus) {
+		now := time.Now()
+		status.FinishedAt = &now
+
+		if err != nil {
+			status.Status = StatusFailed
+			status.Error = err.Error()
+
+			return
+		}
+
+		if result.Skipped {
+			status.Status = StatusSkipped
+
+			return
+		}
+
+		status.Status = StatusSucceeded
+		status.ObjectKey = result.ObjectKey
+		status.Size = result.Size
+	})
+}
+
+func (s *server) runBackup(ctx context.Context, serviceConfig *config.ServiceConfig, talosConfig *talosconfig.Config) (service.Result, error) {
+	talosClient, err := talosclient.New(ctx,
+		talosclient.WithConfig(talosConfig),
+		talosclient.WithGRPCDialOptions(grpc.WithStatsHandler(otelgrpc.NewClientHandler())),
+	)
+	if err != nil {
+		return service.Result{}, fmt.Errorf("failed to create talos client: %w", err)
+	}
+
+	defer talosClient.Close() //nolint:errcheck
+
+	return service.BackupSnapshotWithResult(ctx, serviceConfig, talosConfig, talosClient, serviceConfig.EnableCompression, serviceConfig.DisableEncryption)
+}
+
+func (s *server) job(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.jobs[id]
+}
+
+func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
+	j := s.job(r.PathValue("id"))
+	if j == nil {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+
+		return
+	}
+
+	status, _ := j.snapshot()
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleEvents streams the progress of a job followed by its final status as newline delimited JSON.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	j := s.job(r.PathValue("id"))
+	if j == nil {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	// sent counts the progress records sent, including dropped ones
+	sent := 0
+
+	for {
+		status, changed := j.snapshot()
+
+		// records dropped before they were sent are skipped
+		for _, progress := range status.Progress[max(sent-status.DroppedProgress, 0):] {
+			if err := enc.Encode(progress); err != nil {
+				return
+			}
+		}
+
+		sent = status.DroppedProgress + len(status.Progress)
+
+		if status.Status != StatusRunning {
+			status.Progress = nil
+
+			enc.Encode(status) //nolint:errcheck,errchkjson
+
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(v) //nolint:errcheck,errchkjson
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,240 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+)
+
+const testToken = "secret"
+
+func testServer(t *testing.T, token string) (*server, *httptest.Server) {
+	t.Helper()
+
+	s := newServer(&config.ServiceConfig{Server: config.ServerConfig{Token: token}})
+
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+
+	return s, srv
+}
+
+func request(t *testing.T, method, url, token, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), method, url, strings.NewReader(body))
+	require.NoError(t, err)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { resp.Body.Close() }) //nolint:errcheck
+
+	return resp
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name          string
+		configured    string
+		authorization string
+		expected      int
+	}{
+		{
+			name:       "missing",
+			configured: testToken,
+			expected:   http.StatusUnauthorized,
+		},
+		{
+			name:          "wrong scheme",
+			configured:    testToken,
+			authorization: "Basic " + testToken,
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:          "wrong token",
+			configured:    testToken,
+			authorization: "Bearer other",
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:          "empty token",
+			authorization: "Bearer ",
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:          "valid",
+			configured:    testToken,
+			authorization: "Bearer " + testToken,
+			expected:      http.StatusNotFound,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, srv := testServer(t, test.configured)
+
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/v1/backups/unknown", nil)
+			require.NoError(t, err)
+
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+
+			defer resp.Body.Close() //nolint:errcheck
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+
+			if test.expected == http.StatusUnauthorized {
+				assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+// TestCreateConflict can't run in parallel as it sets TALOSCONFIG.
+func TestCreateConflict(t *testing.T) {
+	talosConfig := filepath.Join(t.TempDir(), "talosconfig")
+
+	require.NoError(t, os.WriteFile(talosConfig, []byte(`context: first
+contexts:
+  first:
+    endpoints: [127.0.0.1]
+  second:
+    endpoints: [127.0.0.1]
+`), 0o600))
+
+	t.Setenv("TALOSCONFIG", talosConfig)
+
+	s, srv := testServer(t, testToken)
+
+	running, existing, err := s.startJob("first")
+	require.NoError(t, err)
+	require.False(t, existing)
+
+	for _, body := range []string{"", `{"context": "first"}`} {
+		resp := request(t, http.MethodPost, srv.URL+"/v1/backups", testToken, body)
+
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		var status JobStatus
+
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		assert.Equal(t, running.status.ID, status.ID)
+		assert.Equal(t, StatusRunning, status.Status)
+	}
+
+	resp := request(t, http.MethodPost, srv.URL+"/v1/backups", testToken, `{"context": "missing"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// only the running job is registered
+	assert.Len(t, s.jobs, 1)
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	s, srv := testServer(t, testToken)
+
+	j, _, err := s.startJob("cluster")
+	require.NoError(t, err)
+
+	logger := slog.New(&progressHandler{Handler: slog.NewTextHandler(io.Discard, nil), job: j}).With("job", j.status.ID)
+	logger.Info("taking snapshot", "node", "10.5.0.2")
+
+	resp := request(t, http.MethodGet, srv.URL+"/v1/backups/"+j.status.ID+"/events", testToken, "")
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	lines := bufio.NewScanner(resp.Body)
+
+	var progress Progress
+
+	require.True(t, lines.Scan())
+	require.NoError(t, json.Unmarshal(lines.Bytes(), &progress))
+	assert.Equal(t, "taking snapshot", progress.Message)
+	assert.Equal(t, map[string]any{"job": j.status.ID, "node": "10.5.0.2"}, progress.Attrs)
+
+	// progress recorded while streaming is sent as it happens
+	logger.Warn("retrying upload", "error", errors.New("connection reset"))
+
+	require.True(t, lines.Scan())
+	require.NoError(t, json.Unmarshal(lines.Bytes(), &progress))
+	assert.Equal(t, "retrying upload", progress.Message)
+	assert.Equal(t, "WARN", progress.Level)
+	assert.Equal(t, "connection reset", progress.Attrs["error"])
+
+	j.update(func(status *JobStatus) {
+		now := time.Now()
+		status.FinishedAt = &now
+		status.Status = StatusSucceeded
+		status.ObjectKey = "cluster/snapshot.part"
+	})
+	s.finishJob(j)
+
+	var status JobStatus
+
+	require.True(t, lines.Scan())
+	require.NoError(t, json.Unmarshal(lines.Bytes(), &status))
+	assert.Equal(t, StatusSucceeded, status.Status)
+	assert.Equal(t, "cluster/snapshot.part", status.ObjectKey)
+	assert.Empty(t, status.Progress)
+
+	assert.False(t, lines.Scan())
+	require.NoError(t, lines.Err())
+
+	// the finished job can still be polled
+	resp = request(t, http.MethodGet, srv.URL+"/v1/backups/"+j.status.ID, testToken, "")
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, StatusSucceeded, status.Status)
+	assert.Len(t, status.Progress, 2)
+}
+
+func TestProgressLimit(t *testing.T) {
+	t.Parallel()
+
+	j := newJob("id", "cluster")
+	logger := slog.New(&progressHandler{Handler: slog.NewTextHandler(io.Discard, nil), job: j})
+
+	for i := range maxProgress + 10 {
+		logger.Info(fmt.Sprintf("record %d", i))
+	}
+
+	status, _ := j.snapshot()
+
+	assert.Len(t, status.Progress, maxProgress)
+	assert.Equal(t, 10, status.DroppedProgress)
+	assert.Equal(t, "record 10", status.Progress[0].Message)
+	assert.Equal(t, fmt.Sprintf("record %d", maxProgress+9), status.Progress[maxProgress-1].Message)
+}
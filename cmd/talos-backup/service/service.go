@@ -7,79 +7,471 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/minio/minio-go/v7"
 	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
 	talosconfig "github.com/siderolabs/talos/pkg/machinery/client/config"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/siderolabs/talos-backup/pkg/compression"
 	"github.com/siderolabs/talos-backup/pkg/config"
 	"github.com/siderolabs/talos-backup/pkg/encryption"
+	"github.com/siderolabs/talos-backup/pkg/httpclient"
+	"github.com/siderolabs/talos-backup/pkg/lock"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+	"github.com/siderolabs/talos-backup/pkg/metrics"
+	"github.com/siderolabs/talos-backup/pkg/notify"
+	"github.com/siderolabs/talos-backup/pkg/ratelimit"
+	"github.com/siderolabs/talos-backup/pkg/retry"
 	"github.com/siderolabs/talos-backup/pkg/s3"
 	"github.com/siderolabs/talos-backup/pkg/talos"
+	"github.com/siderolabs/talos-backup/pkg/tracing"
 	"github.com/siderolabs/talos-backup/pkg/util"
 )
 
+// artifact is the kind of an uploaded artifact, as reported in errors, logs and metrics.
+type artifact string
+
+// Uploaded artifacts.
+const (
+	artifactSnapshot       artifact = metrics.StageSnapshot
+	artifactMachineConfigs artifact = "machine configs"
+	artifactSecretsBundle  artifact = "secrets bundle"
+)
+
+// backup holds the state shared by the stages of a single backup run.
+type backup struct {
+	serviceConfig *config.ServiceConfig
+	talosClient   *talosclient.Client
+	s3Client      *minio.Client
+	s3Info        config.S3Info
+	clusterName   string
+	s3Prefix      string
+	// snapshotUpload describes the uploaded etcd snapshot.
+	snapshotUpload minio.UploadInfo
+	// uploadedKeys are the keys of all artifacts uploaded so far.
+	uploadedKeys      []string
+	enableCompression bool
+	disableEncryption bool
+}
+
+// Result describes a successful backup.
+//
+// If the backup failed, only ObjectKeys is set, to the artifacts uploaded before the failure.
+type Result struct {
+	// ObjectKey is the key of the uploaded etcd snapshot.
+	ObjectKey string
+	// ObjectKeys are the keys of all uploaded artifacts, i.e. the snapshot, machine configs and secrets bundle.
+	ObjectKeys []string
+	Size       int64
+	Duration   time.Duration
+	// Skipped is true if the backup was skipped as another backup of the cluster held the lock, uploading nothing.
+	Skipped bool
+}
+
 // BackupSnapshot takes a snapshot of etcd, encrypts it or not and uploads it to S3.
+// If enabled, the machine configs of the control plane nodes and the secrets bundle are uploaded alongside it.
 func BackupSnapshot(ctx context.Context, serviceConfig *config.ServiceConfig, talosConfig *talosconfig.Config, talosClient *talosclient.Client, enableCompression bool, disableEncryption bool) error {
+	_, err := BackupSnapshotWithResult(ctx, serviceConfig, talosConfig, talosClient, enableCompression, disableEncryption)
+
+	return err
+}
+
+// BackupSnapshotWithResult is BackupSnapshot, additionally returning the uploaded snapshot.
+func BackupSnapshotWithResult(
+	ctx context.Context, serviceConfig *config.ServiceConfig, talosConfig *talosconfig.Config, talosClient *talosclient.Client, enableCompression bool, disableEncryption bool,
+) (Result, error) {
 	clusterName := serviceConfig.ClusterName
 	if clusterName == "" {
 		clusterName = talosConfig.Context
 	}
 
-	snapshotPath, err := talos.TakeEtcdSnapshot(ctx, talosClient, clusterName)
+	b := &backup{
+		serviceConfig: serviceConfig,
+		talosClient:   talosClient,
+		s3Info: config.S3Info{
+			Bucket: serviceConfig.Bucket,
+		},
+		clusterName:       clusterName,
+		s3Prefix:          serviceConfig.S3Prefix,
+		enableCompression: enableCompression,
+		disableEncryption: disableEncryption,
+	}
+
+	if b.s3Prefix == "" {
+		b.s3Prefix = clusterName
+	}
+
+	ctx = logging.With(ctx, logging.KeyCluster, clusterName)
+
+	ctx, span := tracing.Start(ctx, "BackupSnapshot")
+	span.SetAttributes(attribute.String(logging.KeyCluster, clusterName))
+
+	start := time.Now()
+
+	httpClient := httpclient.New(serviceConfig.HTTP)
+
+	notify.HeartbeatStart(ctx, httpClient, serviceConfig.Heartbeat)
+
+	err := b.run(ctx)
+
+	skipped := errors.Is(err, lock.ErrSkipped)
+	if skipped {
+		logging.FromContext(ctx).Info("skipping backup", logging.Error(err))
+
+		// the backup holding the lock covers this run, so the heartbeat monitor must not consider it missing
+		err = nil
+
+		metrics.ObserveSkipped(clusterName)
+	} else {
+		metrics.ObserveResult(clusterName, err)
+	}
+
+	tracing.End(span, err)
+
+	event := notify.Event{
+		Timestamp: time.Now(),
+		Cluster:   clusterName,
+		ObjectKey: b.snapshotUpload.Key,
+		Size:      b.snapshotUpload.Size,
+		Duration:  time.Since(start),
+		Success:   err == nil && !skipped,
+		Skipped:   skipped,
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	// notify even if the backup failed because ctx was canceled
+	notifyCtx := context.WithoutCancel(ctx)
+
+	notify.HeartbeatResult(notifyCtx, httpClient, serviceConfig.Heartbeat, err)
+	notify.Notify(notifyCtx, httpClient, serviceConfig.Webhook, event)
+	notify.RecordKubernetesEvent(notifyCtx, serviceConfig.Kubernetes, event)
+
+	if serviceConfig.PushgatewayURL != "" {
+		if pushErr := metrics.Push(ctx, httpClient, serviceConfig.PushgatewayURL, clusterName); pushErr != nil {
+			logging.FromContext(ctx).Warn("failed to push metrics", logging.Error(pushErr))
+		}
+	}
+
+	if err != nil {
+		return Result{ObjectKeys: b.uploadedKeys}, err
+	}
+
+	if skipped {
+		return Result{Skipped: true}, nil
+	}
+
+	return Result{
+		ObjectKey:  event.ObjectKey,
+		ObjectKeys: b.uploadedKeys,
+		Size:       event.Size,
+		Duration:   event.Duration,
+	}, nil
+}
+
+func (b *backup) run(ctx context.Context) (retErr error) {
+	if (b.serviceConfig.BackupSecrets || b.serviceConfig.BackupMachineConfigs) && b.serviceConfig.AgeX25519PublicKey == "" {
+		return fmt.Errorf("an age public key is required to back up the secrets bundle or machine configs")
+	}
+
+	if b.serviceConfig.Lock.Enabled {
+		lockCtx, release, err := lock.Acquire(ctx, b.serviceConfig.Lock, b.clusterName)
+		if err != nil {
+			return fmt.Errorf("failed to acquire backup lock: %w", err)
+		}
+
+		defer release()
+
+		// report losing the lock rather than a bare context cancellation
+		defer func() {
+			if cause := context.Cause(lockCtx); errors.Is(cause, lock.ErrLost) && retErr != nil {
+				retErr = fmt.Errorf("%w: %w", cause, retErr)
+			}
+		}()
+
+		ctx = lockCtx
+	}
+
+	var err error
+
+	b.s3Client, err = s3.CreateClientWithCustomEndpoint(ctx, b.serviceConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	health := "unchecked"
+
+	if b.serviceConfig.EtcdHealthCheck != config.HealthCheckDisabled {
+		stageCtx, done := b.stage(ctx, metrics.StageHealthCheck)
+
+		report, healthErr := b.checkEtcdHealth(stageCtx)
+
+		done(healthErr)
+
+		if healthErr != nil {
+			return healthErr
+		}
+
+		if report != nil {
+			health = report.String()
+		}
+	}
+
+	stageCtx, done := b.stage(ctx, metrics.StageSnapshot)
+
+	snapshot, err := talos.TakeEtcdSnapshot(stageCtx, b.talosClient, b.clusterName, b.serviceConfig.Retry, b.serviceConfig.RateLimit.Snapshot)
+
+	done(err)
+
 	if err != nil {
 		return fmt.Errorf("failed to take etcd snapshot: %w", err)
 	}
 
-	defer util.CleanupFile(snapshotPath)
+	defer util.CleanupFile(ctx, snapshot.Path)
+
+	metrics.ObserveSnapshotSize(b.clusterName, snapshot.Size)
+
+	metadata := map[string]string{
+		s3.MetadataEtcdRevision:        strconv.FormatInt(snapshot.Revision, 10),
+		s3.MetadataEtcdConsistentIndex: strconv.FormatUint(snapshot.ConsistentIndex, 10),
+		s3.MetadataEtcdDBSize:          strconv.FormatInt(snapshot.Size, 10),
+		s3.MetadataEtcdHealth:          health,
+	}
+
+	if snapshot.Node != "" {
+		metadata[s3.MetadataTalosNode] = snapshot.Node
+	}
+
+	if b.snapshotUpload, err = b.uploadArtifact(ctx, snapshot.Path, artifactSnapshot, metadata, b.disableEncryption); err != nil {
+		return err
+	}
+
+	if b.checkDBGrowth() {
+		if err = s3.RecordSnapshotDBSize(ctx, b.s3Info, b.s3Client, b.s3Prefix, b.clusterName, b.snapshotUpload.Key, snapshot.Size, recentBackupCount); err != nil {
+			logging.FromContext(ctx).Warn("failed to record the database size of the snapshot", logging.Error(err))
+		}
+	}
+
+	if b.serviceConfig.BackupMachineConfigs {
+		stageCtx, done = b.stage(ctx, metrics.StageMachineConfigs)
+
+		machineConfigsPath, machineConfigsErr := talos.SaveMachineConfigs(stageCtx, b.talosClient, b.clusterName, snapshot.Timestamp)
+
+		done(machineConfigsErr)
+
+		if machineConfigsErr != nil {
+			return fmt.Errorf("failed to save machine configs: %w", machineConfigsErr)
+		}
+
+		defer util.CleanupFile(ctx, machineConfigsPath)
+
+		// the machine configs hold the cluster secrets, so they are always encrypted like the secrets bundle
+		if _, err = b.uploadArtifact(ctx, machineConfigsPath, artifactMachineConfigs, nil, false); err != nil {
+			return err
+		}
+	}
+
+	if b.serviceConfig.BackupSecrets {
+		stageCtx, done = b.stage(ctx, metrics.StageSecrets)
+
+		secretsBundlePath, secretsErr := talos.SaveSecretsBundle(stageCtx, b.talosClient, b.clusterName, snapshot.Timestamp)
+
+		done(secretsErr)
+
+		if secretsErr != nil {
+			return fmt.Errorf("failed to save secrets bundle: %w", secretsErr)
+		}
+
+		defer util.CleanupFile(ctx, secretsBundlePath)
+
+		// the secrets bundle is always encrypted, regardless of disableEncryption
+		if _, err = b.uploadArtifact(ctx, secretsBundlePath, artifactSecretsBundle, nil, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uploadArtifact compresses and encrypts the file at path as configured and uploads it to S3.
+func (b *backup) uploadArtifact(ctx context.Context, path string, kind artifact, metadata map[string]string, disableEncryption bool) (minio.UploadInfo, error) {
+	if b.enableCompression {
+		stageCtx, done := b.stage(ctx, metrics.StageCompress)
+
+		compressedFileName, compressionErr := compression.CompressFile(stageCtx, path, b.serviceConfig.Compression)
+
+		done(compressionErr)
 
-	if enableCompression {
-		compressedFileName, compressionErr := compression.CompressFile(snapshotPath)
 		if compressionErr != nil {
-			return fmt.Errorf("failed to compress etcd snapshot: %w", compressionErr)
+			return minio.UploadInfo{}, fmt.Errorf("failed to compress %s: %w", kind, compressionErr)
 		}
 
-		defer util.CleanupFile(compressedFileName)
+		defer util.CleanupFile(ctx, compressedFileName)
 
-		snapshotPath = compressedFileName
+		path = compressedFileName
+		metadata = compressionMetadata(metadata, b.serviceConfig.Compression)
 	}
 
 	if !disableEncryption {
-		encryptedFileName, encryptionErr := encryption.EncryptFile(snapshotPath, serviceConfig.AgeX25519PublicKey)
+		stageCtx, done := b.stage(ctx, metrics.StageEncrypt)
+
+		encryptedFileName, encryptionErr := encryption.EncryptFile(stageCtx, path, b.serviceConfig.AgeX25519PublicKey)
+
+		done(encryptionErr)
+
 		if encryptionErr != nil {
-			return fmt.Errorf("failed to encrypt etcd snapshot: %w", encryptionErr)
+			return minio.UploadInfo{}, fmt.Errorf("failed to encrypt %s: %w", kind, encryptionErr)
 		}
 
-		defer util.CleanupFile(encryptedFileName)
+		defer util.CleanupFile(ctx, encryptedFileName)
 
-		snapshotPath = encryptedFileName
+		path = encryptedFileName
 	}
 
-	client, err := s3.CreateClientWithCustomEndpoint(ctx, serviceConfig)
+	stageCtx, done := b.stage(ctx, metrics.StageUpload)
+	uploadStart := time.Now()
+
+	info, err := s3.PushSnapshot(stageCtx, b.s3Info, b.serviceConfig.Retry, b.serviceConfig.Multipart, b.serviceConfig.RateLimit.Upload,
+		b.s3Client, b.s3Prefix, path, metadata)
+
+	uploadDuration := time.Since(uploadStart)
+
+	done(err)
+
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		if !disableEncryption {
+			return minio.UploadInfo{}, fmt.Errorf("failed to push encrypted %s: %w", kind, err)
+		}
+
+		return minio.UploadInfo{}, fmt.Errorf("failed to push %s: %w", kind, err)
 	}
 
-	s3Info := config.S3Info{
-		Bucket: serviceConfig.Bucket,
+	b.uploadedKeys = append(b.uploadedKeys, info.Key)
+
+	if b.serviceConfig.VerifyUpload {
+		stageCtx, done = b.stage(ctx, metrics.StageVerify)
+
+		err = b.verifyUpload(stageCtx, info.Key, path, kind, !disableEncryption)
+
+		done(err)
+
+		if err != nil {
+			return minio.UploadInfo{}, fmt.Errorf("failed to verify uploaded %s: %w", kind, err)
+		}
 	}
 
-	s3Prefix := serviceConfig.S3Prefix
-	if s3Prefix == "" {
-		s3Prefix = clusterName
+	metrics.ObserveUploadedSize(b.clusterName, string(kind), info.Size)
+
+	logging.FromContext(ctx).Info("artifact uploaded", "artifact", kind, logging.KeyObjectKey, info.Key, logging.KeyBytes, info.Size,
+		logging.KeyBytesPerSecond, ratelimit.BytesPerSecond(info.Size, uploadDuration), "checksum_sha256", info.ChecksumSHA256)
+
+	return info, nil
+}
+
+// compressionMetadata returns a copy of metadata recording the compression settings, which restores may need,
+// e.g. to allow the window size when decompressing.
+func compressionMetadata(metadata map[string]string, compressionConfig config.CompressionConfig) map[string]string {
+	metadata = maps.Clone(metadata)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	metadata[s3.MetadataCompression] = "zstd"
+	metadata[s3.MetadataCompressionLevel] = compressionConfig.Level
+
+	if compressionConfig.WindowSize > 0 {
+		metadata[s3.MetadataCompressionWindow] = strconv.FormatInt(compressionConfig.WindowSize, 10)
+	}
+
+	return metadata
+}
+
+// stage starts a span for stage and returns a copy of ctx whose logger is tagged with stage,
+// and a function which records the outcome of the stage.
+func (b *backup) stage(ctx context.Context, stage string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx = logging.With(ctx, logging.KeyStage, stage)
+	ctx = retry.WithObserver(ctx, func() { metrics.ObserveRetry(b.clusterName, stage) })
+	ctx, span := tracing.Start(ctx, stage)
+
+	return ctx, func(err error) {
+		tracing.End(span, err)
+
+		metrics.ObserveStage(b.clusterName, stage, start, err)
+
+		logger := logging.FromContext(ctx).With(logging.KeyDuration, time.Since(start))
+
+		if err != nil {
+			logger.Error("stage failed", logging.Error(err))
+
+			return
+		}
+
+		logger.Debug("stage completed")
+	}
+}
+
+// recentBackupCount is the number of recent backups the database size is compared against.
+const recentBackupCount = 5
+
+// checkDBGrowth returns true if the database size is checked against the recent backups,
+// whose sizes are recorded in an index object next to the snapshots.
+func (b *backup) checkDBGrowth() bool {
+	return b.serviceConfig.EtcdHealthCheck != config.HealthCheckDisabled && b.serviceConfig.EtcdDBSizeGrowthFactor > 0
+}
+
+// checkEtcdHealth runs the etcd pre-flight checks, returning an error if etcd is unhealthy and the checks are enforced.
+//
+// In warn mode, failing to run the checks is logged as well and a nil report is returned.
+func (b *backup) checkEtcdHealth(ctx context.Context) (*talos.HealthReport, error) {
+	logger := logging.FromContext(ctx)
+	warn := b.serviceConfig.EtcdHealthCheck == config.HealthCheckWarn
+
+	var recentDBSizes []int64
+
+	if b.checkDBGrowth() {
+		var err error
+
+		if recentDBSizes, err = s3.RecentSnapshotDBSizes(ctx, b.s3Info, b.s3Client, b.s3Prefix, b.clusterName); err != nil {
+			logger.Warn("failed to get database sizes of recent backups", logging.Error(err))
+		}
 	}
 
-	err = s3.PushSnapshot(ctx, s3Info, client, s3Prefix, snapshotPath)
+	report, err := talos.CheckEtcdHealth(ctx, b.talosClient, recentDBSizes, b.serviceConfig.EtcdDBSizeGrowthFactor)
 	if err != nil {
-		snapshotType := "snapshot"
+		if warn {
+			logger.Warn("failed to check etcd health, taking snapshot anyway", logging.Error(err))
 
-		if !disableEncryption {
-			snapshotType = "encrypted snapshot"
+			return nil, nil //nolint:nilnil
 		}
 
-		return fmt.Errorf("failed to push %s: %w", snapshotType, err)
+		return nil, fmt.Errorf("failed to check etcd health: %w", err)
 	}
 
-	return nil
+	if len(report.Warnings) > 0 {
+		logger.Warn("etcd health check warnings", "warnings", strings.Join(report.Warnings, "; "))
+	}
+
+	if report.Healthy() {
+		logger.Info("etcd health check passed", "db_size", report.DBSize)
+
+		return report, nil
+	}
+
+	if warn {
+		logger.Warn("etcd health check failed, taking snapshot anyway", "problems", strings.Join(report.Problems, "; "))
+
+		return report, nil
+	}
+
+	return nil, fmt.Errorf("etcd health check failed, refusing to take snapshot: %s", strings.Join(report.Problems, "; "))
 }
@@ -0,0 +1,132 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/siderolabs/talos-backup/pkg/compression"
+	"github.com/siderolabs/talos-backup/pkg/encryption"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+	"github.com/siderolabs/talos-backup/pkg/retry"
+	"github.com/siderolabs/talos-backup/pkg/s3"
+	"github.com/siderolabs/talos-backup/pkg/talos"
+)
+
+// errVerificationFailed is returned if an uploaded object doesn't match the local artifact.
+var errVerificationFailed = errors.New("the uploaded object doesn't match the local artifact")
+
+// verifyUpload reads the object at key back and compares its SHA-256 with the local artifact at path.
+//
+// If the object is an etcd snapshot which can be decrypted, it is also decrypted and decompressed
+// while it is read to check the checksum etcd appends to snapshots.
+func (b *backup) verifyUpload(ctx context.Context, key, path string, kind artifact, encrypted bool) error {
+	expected, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+
+	checkTrailer := kind == artifactSnapshot && (!encrypted || b.serviceConfig.AgeX25519Identity != "")
+
+	err = retry.Do(ctx, b.serviceConfig.Retry, "verification", s3.IsRetryable, func(ctx context.Context) error {
+		object, err := b.s3Client.GetObject(ctx, b.s3Info.Bucket, key, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+
+		defer object.Close() //nolint:errcheck
+
+		hash := sha256.New()
+		r := io.TeeReader(object, hash)
+
+		if checkTrailer {
+			if err = b.verifySnapshotTrailer(r, encrypted); err != nil {
+				return err
+			}
+		}
+
+		// hash the rest of the object
+		if _, err = io.Copy(io.Discard, r); err != nil {
+			return fmt.Errorf("failed to read back %q: %w", key, err)
+		}
+
+		if actual := hash.Sum(nil); !bytes.Equal(actual, expected) {
+			return fmt.Errorf("%w: expected SHA-256 %x, got %x", errVerificationFailed, expected, actual)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("upload verified", logging.KeyObjectKey, key, "snapshot_checksum_verified", checkTrailer)
+
+	return nil
+}
+
+// verifySnapshotTrailer decrypts and decompresses the etcd snapshot read from r as configured and verifies its checksum.
+func (b *backup) verifySnapshotTrailer(r io.Reader, encrypted bool) error {
+	var decrypted io.Reader
+
+	if encrypted {
+		var err error
+
+		if decrypted, err = encryption.NewDecryptingReader(r, b.serviceConfig.AgeX25519Identity); err != nil {
+			return fmt.Errorf("%w: %w", errVerificationFailed, err)
+		}
+
+		r = decrypted
+	}
+
+	if b.enableCompression {
+		decompressed, err := compression.NewDecompressingReader(r)
+		if err != nil {
+			return err
+		}
+
+		defer decompressed.Close() //nolint:errcheck
+
+		r = decompressed
+	}
+
+	if _, err := talos.VerifySnapshotHash(r); err != nil {
+		return fmt.Errorf("%w: %w", errVerificationFailed, err)
+	}
+
+	// age authenticates the last chunk only once it is read to the end
+	if decrypted != nil {
+		if _, err := io.Copy(io.Discard, decrypted); err != nil {
+			return fmt.Errorf("%w: %w", errVerificationFailed, err)
+		}
+	}
+
+	return nil
+}
+
+func fileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	hash := sha256.New()
+
+	if _, err = io.Copy(hash, f); err != nil {
+		return nil, fmt.Errorf("failed to hash %q: %w", path, err)
+	}
+
+	return hash.Sum(nil), nil
+}
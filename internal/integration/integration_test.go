@@ -393,3 +393,41 @@ func (suite *integrationTestSuite) TestBackupEncryptedSnapshot() {
 		suite.Require().Greater(msg.Size, int64(0))
 	}
 }
+
+func (suite *integrationTestSuite) TestBackupMultipartSnapshot() {
+	// given
+	suite.serviceConfig.S3Prefix = "testdata/multipart"
+	suite.serviceConfig.Multipart = pkgconfig.MultipartConfig{
+		Threshold:   1,
+		PartSize:    5 << 20,
+		Concurrency: 2,
+	}
+
+	// when
+	suite.Require().Nil(
+		service.BackupSnapshot(suite.ctx, &suite.serviceConfig, suite.talosConfig, suite.talosClient, false, true),
+	)
+
+	// then
+	var keys []string
+
+	for msg := range suite.minioClient.ListObjects(suite.ctx, suite.serviceConfig.Bucket, minio.ListObjectsOptions{
+		Prefix:    suite.serviceConfig.S3Prefix,
+		Recursive: true,
+	}) {
+		suite.Require().Nil(msg.Err)
+
+		suite.Require().Regexp(regexp.MustCompile(`testdata/multipart/talos-test-cluster-\d\d\d\d-\d\d-\d\dT\d\d:\d\d:\d\dZ\.snap$`), msg.Key)
+
+		keys = append(keys, msg.Key)
+	}
+
+	suite.Require().Len(keys, 1)
+
+	info, err := suite.minioClient.StatObject(suite.ctx, suite.serviceConfig.Bucket, keys[0], minio.StatObjectOptions{})
+	suite.Require().Nil(err)
+
+	// the ETag of a multipart upload is suffixed with the number of parts
+	suite.Require().Regexp(regexp.MustCompile(`-\d+$`), info.ETag)
+	suite.Require().Greater(info.Size, int64(0))
+}
@@ -6,28 +6,42 @@
 package compression
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 
 	"github.com/klauspost/compress/zstd"
 
+	"github.com/siderolabs/talos-backup/pkg/config"
 	"github.com/siderolabs/talos-backup/pkg/util"
 )
 
-// CompressFile compresses the file at fileToCompressPath and returns the name of the compressed file.
-func CompressFile(fileToCompressPath string) (string, error) {
-	compressedFileName, err := compressFile(fileToCompressPath)
+// CompressFile compresses the file at fileToCompressPath with the level, concurrency and window size of compressionConfig
+// and returns the name of the compressed file.
+func CompressFile(ctx context.Context, fileToCompressPath string, compressionConfig config.CompressionConfig) (string, error) {
+	compressedFileName, err := compressFile(fileToCompressPath, compressionConfig)
 
-	if err != nil && compressedFileName != "" {
-		util.CleanupFile(compressedFileName)
+	if err != nil {
+		if compressedFileName != "" {
+			util.CleanupFile(ctx, compressedFileName)
+		}
+
+		return "", err
 	}
 
-	return compressedFileName, err
+	return compressedFileName, nil
 }
 
 // Compress input to output.
-func compressFile(fileToCompressPath string) (string, error) {
+//
+// The name of the compressed file is returned along with errors once it was created, so that it can be removed.
+func compressFile(fileToCompressPath string, compressionConfig config.CompressionConfig) (string, error) {
+	opts, err := encoderOptions(compressionConfig)
+	if err != nil {
+		return "", err
+	}
+
 	fileToCompress, err := os.Open(fileToCompressPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open file for Compression %q: %w", fileToCompressPath, err)
@@ -44,24 +58,61 @@ func compressFile(fileToCompressPath string) (string, error) {
 
 	defer compressedFile.Close() //nolint:errcheck
 
-	encoder, err := zstd.NewWriter(compressedFile)
+	encoder, err := zstd.NewWriter(compressedFile, opts...)
 	if err != nil {
-		return "", err
+		return compressedFileName, fmt.Errorf("failed to create compressor: %w", err)
 	}
 
 	defer encoder.Close() //nolint:errcheck
 
 	if _, err := io.Copy(encoder, fileToCompress); err != nil {
-		return "", fmt.Errorf("failed to write compressed file %q: %w", compressedFileName, err)
+		return compressedFileName, fmt.Errorf("failed to write compressed file %q: %w", compressedFileName, err)
 	}
 
 	if err := encoder.Close(); err != nil {
-		return "", fmt.Errorf("failed to close writer: %w", err)
+		return compressedFileName, fmt.Errorf("failed to close writer: %w", err)
 	}
 
 	if err := compressedFile.Sync(); err != nil {
-		return "", fmt.Errorf("failed to sync compressed file to disk: %w", err)
+		return compressedFileName, fmt.Errorf("failed to sync compressed file to disk: %w", err)
 	}
 
 	return compressedFileName, nil
 }
+
+// encoderOptions returns the zstd encoder options of compressionConfig, an unset level being the default one.
+//
+// The window size is validated by zstd when the encoder is created.
+func encoderOptions(compressionConfig config.CompressionConfig) ([]zstd.EOption, error) {
+	level := zstd.SpeedDefault
+
+	if compressionConfig.Level != "" {
+		var ok bool
+
+		if ok, level = zstd.EncoderLevelFromString(compressionConfig.Level); !ok {
+			return nil, fmt.Errorf("invalid compression level %q: must be fastest, default, better or best", compressionConfig.Level)
+		}
+	}
+
+	opts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+
+	if compressionConfig.Concurrency > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(compressionConfig.Concurrency))
+	}
+
+	if compressionConfig.WindowSize > 0 {
+		opts = append(opts, zstd.WithWindowSize(int(compressionConfig.WindowSize)))
+	}
+
+	return opts, nil
+}
+
+// NewDecompressingReader returns a reader decompressing the zstd stream src.
+func NewDecompressingReader(src io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decompressor: %w", err)
+	}
+
+	return decoder.IOReadCloser(), nil
+}
@@ -0,0 +1,118 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package compression
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+)
+
+func TestEncoderOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		level       string
+		expectedErr string
+	}{
+		{level: ""},
+		{level: config.CompressionLevelFastest},
+		{level: config.CompressionLevelDefault},
+		{level: config.CompressionLevelBetter},
+		{level: config.CompressionLevelBest},
+		{level: "Best"},
+		{level: "ultra", expectedErr: `invalid compression level "ultra"`},
+		{level: "19", expectedErr: `invalid compression level "19"`},
+	} {
+		t.Run(test.level, func(t *testing.T) {
+			t.Parallel()
+
+			opts, err := encoderOptions(config.CompressionConfig{Level: test.level})
+
+			if test.expectedErr != "" {
+				assert.ErrorContains(t, err, test.expectedErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Len(t, opts, 1)
+		})
+	}
+}
+
+func TestCompressFile(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("etcd snapshot "), 10000)
+
+	for _, test := range []struct {
+		name        string
+		config      config.CompressionConfig
+		expectedErr string
+	}{
+		{
+			name:   "default",
+			config: config.CompressionConfig{Level: config.CompressionLevelDefault},
+		},
+		{
+			name:   "window size",
+			config: config.CompressionConfig{Level: config.CompressionLevelBetter, Concurrency: 2, WindowSize: 1 << 10},
+		},
+		{
+			name:        "invalid level",
+			config:      config.CompressionConfig{Level: "ultra"},
+			expectedErr: "invalid compression level",
+		},
+		{
+			name:        "window size not a power of two",
+			config:      config.CompressionConfig{Level: config.CompressionLevelDefault, WindowSize: 1000},
+			expectedErr: "failed to create compressor",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "snapshot.db")
+			require.NoError(t, os.WriteFile(path, data, 0o600))
+
+			compressedPath, err := CompressFile(t.Context(), path, test.config)
+
+			if test.expectedErr != "" {
+				require.ErrorContains(t, err, test.expectedErr)
+
+				// the partially written file is removed
+				_, err = os.Stat(path + ".zst")
+				assert.ErrorIs(t, err, os.ErrNotExist)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, path+".zst", compressedPath)
+
+			compressed, err := os.Open(compressedPath)
+			require.NoError(t, err)
+
+			defer compressed.Close() //nolint:errcheck
+
+			r, err := NewDecompressingReader(compressed)
+			require.NoError(t, err)
+
+			defer r.Close() //nolint:errcheck
+
+			decompressed, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, data, decompressed)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// reloadInterval is the interval at which the secret files are checked for changes.
+const reloadInterval = 10 * time.Second
+
+// Reloader holds the service config of a long-running mode, reloading it when a secret file changes,
+// e.g. when a mounted Secret is rotated.
+type Reloader struct {
+	current     atomic.Pointer[ServiceConfig]
+	fingerprint []byte
+}
+
+// NewReloader returns a Reloader holding serviceConfig.
+func NewReloader(serviceConfig *ServiceConfig) *Reloader {
+	r := &Reloader{fingerprint: secretFilesFingerprint()}
+	r.current.Store(serviceConfig)
+
+	return r
+}
+
+// Get returns the current service config, which must not be modified.
+func (r *Reloader) Get() *ServiceConfig {
+	return r.current.Load()
+}
+
+// Run reloads the service config whenever the secret files change until ctx is canceled.
+//
+// A config which fails to load is logged and the previous one is kept.
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	logger := logging.FromContext(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.reload(logger)
+	}
+}
+
+// reload reloads the service config if the secret files changed since it was loaded, returning whether it did.
+func (r *Reloader) reload(logger *slog.Logger) bool {
+	fingerprint := secretFilesFingerprint()
+	if bytes.Equal(fingerprint, r.fingerprint) {
+		return false
+	}
+
+	serviceConfig, err := GetServiceConfig()
+	if err != nil {
+		logger.Error("failed to reload configuration, keeping the previous one", logging.Error(err))
+
+		return false
+	}
+
+	r.fingerprint = fingerprint
+	r.current.Store(serviceConfig)
+
+	logger.Info("configuration reloaded as secret files changed")
+
+	return true
+}
+
+// secretFilesFingerprint returns the hash of the names and contents of the secret files.
+func secretFilesFingerprint() []byte {
+	hash := sha256.New()
+
+	for _, secret := range secretEnvVars {
+		path := os.Getenv(secret.name + fileEnvVarSuffix)
+		if path == "" {
+			continue
+		}
+
+		hash.Write([]byte(secret.name))
+
+		// a missing file is part of the fingerprint as well, and fails the reload
+		if contents, err := os.ReadFile(path); err == nil {
+			sum := sha256.Sum256(contents)
+
+			hash.Write(sum[:])
+		}
+	}
+
+	return hash.Sum(nil)
+}
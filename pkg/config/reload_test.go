@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSecretFilesFingerprint can't run in parallel as it sets the environment.
+func TestSecretFilesFingerprint(t *testing.T) {
+	dir := t.TempDir()
+
+	tokenPath := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("first"), 0o600))
+
+	t.Setenv(serverTokenEnvVar+fileEnvVarSuffix, tokenPath)
+
+	initial := secretFilesFingerprint()
+
+	assert.Equal(t, initial, secretFilesFingerprint(), "unchanged files")
+
+	require.NoError(t, os.WriteFile(tokenPath, []byte("second"), 0o600))
+
+	changed := secretFilesFingerprint()
+	assert.NotEqual(t, initial, changed, "changed contents")
+
+	require.NoError(t, os.Remove(tokenPath))
+
+	removed := secretFilesFingerprint()
+	assert.NotEqual(t, changed, removed, "removed file")
+
+	// the same contents under another variable are a different configuration
+	require.NoError(t, os.WriteFile(tokenPath, []byte("second"), 0o600))
+	t.Setenv(serverTokenEnvVar+fileEnvVarSuffix, "")
+	t.Setenv(webhookSecretEnvVar+fileEnvVarSuffix, tokenPath)
+
+	assert.NotEqual(t, changed, secretFilesFingerprint(), "other variable")
+}
+
+// TestReload can't run in parallel as it sets the environment.
+func TestReload(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("first\n"), 0o600))
+
+	t.Setenv(serverTokenEnvVar, "")
+	t.Setenv(serverTokenEnvVar+fileEnvVarSuffix, tokenPath)
+
+	serviceConfig, err := GetServiceConfig()
+	require.NoError(t, err)
+
+	r := NewReloader(serviceConfig)
+
+	assert.False(t, r.reload(logger), "unchanged files")
+	assert.Same(t, serviceConfig, r.Get())
+
+	// the Secret is rotated
+	require.NoError(t, os.WriteFile(tokenPath, []byte("second\n"), 0o600))
+
+	assert.True(t, r.reload(logger))
+	assert.Equal(t, "second", r.Get().Server.Token)
+
+	assert.False(t, r.reload(logger), "reloaded files")
+
+	// a config which fails to load keeps the previous one and is retried
+	require.NoError(t, os.Remove(tokenPath))
+
+	assert.False(t, r.reload(logger))
+	assert.Equal(t, "second", r.Get().Server.Token)
+
+	require.NoError(t, os.WriteFile(tokenPath, []byte("third\n"), 0o600))
+
+	assert.True(t, r.reload(logger))
+	assert.Equal(t, "third", r.Get().Server.Token)
+}
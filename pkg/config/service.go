@@ -5,43 +5,813 @@
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Etcd health check modes.
+const (
+	// HealthCheckEnforce refuses to take a snapshot of an unhealthy etcd cluster.
+	HealthCheckEnforce = "enforce"
+	// HealthCheckWarn logs the health check problems and takes the snapshot anyway.
+	HealthCheckWarn = "warn"
+	// HealthCheckDisabled skips the health check.
+	HealthCheckDisabled = "disabled"
+)
+
+// Lock contention actions.
+const (
+	// LockSkip skips the backup if another backup of the cluster holds the lock.
+	LockSkip = "skip"
+	// LockWait waits for the lock to be released.
+	LockWait = "wait"
+	// LockFail fails the backup.
+	LockFail = "fail"
+)
+
+// S3 bucket lookup styles.
+const (
+	// BucketLookupAuto uses virtual-hosted style for AWS and path style for other endpoints.
+	BucketLookupAuto = "auto"
+	// BucketLookupPath addresses buckets as endpoint/bucket.
+	BucketLookupPath = "path"
+	// BucketLookupVirtualHost addresses buckets as bucket.endpoint.
+	BucketLookupVirtualHost = "virtual-host"
+)
+
+// Compression levels, trading speed for ratio.
+const (
+	CompressionLevelFastest = "fastest"
+	CompressionLevelDefault = "default"
+	CompressionLevelBetter  = "better"
+	CompressionLevelBest    = "best"
 )
 
+// Webhook payload formats.
+const (
+	WebhookFormatGeneric = "generic"
+	WebhookFormatSlack   = "slack"
+	WebhookFormatTeams   = "teams"
+	WebhookFormatDiscord = "discord"
+)
+
+// WebhookConfig holds configuration values for webhook notifications.
+type WebhookConfig struct {
+	URLs       []string      `yaml:"urls"`
+	Format     string        `yaml:"format"`
+	Template   string        `yaml:"template"`
+	Secret     string        `yaml:"secret"`
+	Timeout    time.Duration `yaml:"timeout"`
+	MaxRetries int           `yaml:"maxRetries"`
+	OnSuccess  bool          `yaml:"onSuccess"`
+}
+
+// HeartbeatConfig holds configuration values for dead man's switch heartbeat pings.
+//
+// StartURL and FailURL default to URL with "/start" and "/fail" appended, as used by healthchecks.io.
+type HeartbeatConfig struct {
+	URL      string        `yaml:"url"`
+	StartURL string        `yaml:"startURL"`
+	FailURL  string        `yaml:"failURL"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// KubernetesConfig holds configuration values for recording backup outcomes in Kubernetes.
+//
+// PodName and Namespace identify the pod talos-backup runs in, as set by the downward API.
+type KubernetesConfig struct {
+	PodName           string `yaml:"podName"`
+	Namespace         string `yaml:"namespace"`
+	StatusConfigMap   string `yaml:"statusConfigMap"`
+	StatusAnnotations bool   `yaml:"statusAnnotations"`
+}
+
+// LockConfig holds configuration values for the Lease preventing overlapping backups of a cluster.
+type LockConfig struct {
+	// Namespace is the namespace of the Lease, defaulting to the namespace talos-backup runs in.
+	Namespace string `yaml:"namespace"`
+	// Identity identifies the holder of the Lease, defaulting to the pod name or the hostname.
+	// A random suffix is appended to it on every acquisition.
+	Identity     string        `yaml:"identity"`
+	OnContention string        `yaml:"onContention"`
+	TTL          time.Duration `yaml:"ttl"`
+	Enabled      bool          `yaml:"enabled"`
+}
+
+// RetryConfig holds configuration values for retrying Talos and S3 operations failing with transient errors.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts including the first one.
+	MaxAttempts     int           `yaml:"maxAttempts"`
+	InitialInterval time.Duration `yaml:"initialInterval"`
+	MaxInterval     time.Duration `yaml:"maxInterval"`
+	// Deadline is the time after which a failed operation is no longer retried, if it is not zero.
+	Deadline time.Duration `yaml:"deadline"`
+}
+
+// MultipartConfig holds configuration values for resumable multipart uploads.
+type MultipartConfig struct {
+	// Threshold is the size from which files are uploaded in parts.
+	Threshold int64 `yaml:"threshold"`
+	PartSize  int64 `yaml:"partSize"`
+	// StaleAfter is the age after which incomplete multipart uploads under the prefix are aborted.
+	StaleAfter  time.Duration `yaml:"staleAfter"`
+	Concurrency int           `yaml:"concurrency"`
+}
+
+// RateLimitConfig holds bandwidth limits in bytes per second, zero meaning unlimited.
+type RateLimitConfig struct {
+	// Snapshot limits reading the etcd snapshot from the Talos API.
+	Snapshot int64 `yaml:"snapshot"`
+	// Upload limits writing artifacts to S3, shared by the concurrent parts of a multipart upload.
+	Upload int64 `yaml:"upload"`
+}
+
+// CompressionConfig holds configuration values for the zstd compression of artifacts.
+type CompressionConfig struct {
+	Level string `yaml:"level"`
+	// Concurrency is the number of goroutines compressing, zero meaning GOMAXPROCS.
+	Concurrency int `yaml:"concurrency"`
+	// WindowSize is the maximum distance of matches in bytes, zero leaving it to the level.
+	WindowSize int64 `yaml:"windowSize"`
+}
+
+// S3CredentialsConfig holds static S3 credentials, taking precedence over the default AWS credential chain.
+type S3CredentialsConfig struct {
+	AccessKeyID     string `yaml:"accessKeyID"`
+	SecretAccessKey string `yaml:"secretAccessKey"`
+	SessionToken    string `yaml:"sessionToken"`
+}
+
+// S3EndpointConfig holds configuration values for addressing the S3 endpoint.
+type S3EndpointConfig struct {
+	// Region overrides the region S3 requests are signed for, e.g. for non-AWS endpoints, defaulting to AWS_REGION.
+	Region       string `yaml:"region"`
+	BucketLookup string `yaml:"bucketLookup"`
+	// DualStack, FIPS and Accelerate select AWS endpoint variants.
+	DualStack  bool `yaml:"dualStack"`
+	FIPS       bool `yaml:"fips"`
+	Accelerate bool `yaml:"accelerate"`
+}
+
+// S3TLSConfig holds TLS configuration values for S3 endpoints, e.g. using an internal CA or requiring client certificates.
+type S3TLSConfig struct {
+	CAFile   string `yaml:"caFile"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// MinVersion is a crypto/tls version constant.
+	MinVersion         uint16 `yaml:"minVersion"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// HTTPConfig holds configuration values for the HTTP transport of S3, webhook, heartbeat and Pushgateway requests.
+type HTTPConfig struct {
+	// ProxyURL is the proxy of all requests, taking precedence over HTTPS_PROXY and HTTP_PROXY.
+	// NO_PROXY is honored either way.
+	ProxyURL string `yaml:"proxyURL"`
+	// ProxyUsername and ProxyPassword authenticate to the proxy unless its URL holds credentials.
+	ProxyUsername  string        `yaml:"proxyUsername"`
+	ProxyPassword  string        `yaml:"proxyPassword"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	// ResponseTimeout limits the time waiting for the response headers after the request was written.
+	ResponseTimeout     time.Duration `yaml:"responseTimeout"`
+	KeepAlive           time.Duration `yaml:"keepAlive"`
+	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout"`
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost"`
+}
+
+// AssumeRoleConfig holds configuration values for assuming an IAM role to access the bucket, e.g. in another account.
+type AssumeRoleConfig struct {
+	RoleARN     string        `yaml:"roleARN"`
+	ExternalID  string        `yaml:"externalID"`
+	SessionName string        `yaml:"sessionName"`
+	Duration    time.Duration `yaml:"duration"`
+}
+
+// ServerConfig holds configuration values for the on-demand backup server.
+type ServerConfig struct {
+	Address string `yaml:"address"`
+	// Token is the bearer token clients have to present.
+	Token string `yaml:"token"`
+}
+
 // ServiceConfig holds configuration values for the etcd snapshot service.
 // The parameters CustomS3Endpoint, s3Prefix, clusterName are optional.
 type ServiceConfig struct {
-	CustomS3Endpoint   string `yaml:"customS3Endpoint"`
-	Bucket             string `yaml:"bucket"`
-	Region             string `yaml:"region"`
-	S3Prefix           string `yaml:"s3Prefix"`
-	ClusterName        string `yaml:"clusterName"`
-	AgeX25519PublicKey string `yaml:"ageX25519PublicKey"`
-	EnableCompression  bool   `yaml:"enableCompression"`
-	DisableEncryption  bool   `yaml:"disableEncryption"`
+	CustomS3Endpoint       string              `yaml:"customS3Endpoint"`
+	Bucket                 string              `yaml:"bucket"`
+	Region                 string              `yaml:"region"`
+	S3Prefix               string              `yaml:"s3Prefix"`
+	ClusterName            string              `yaml:"clusterName"`
+	AgeX25519PublicKey     string              `yaml:"ageX25519PublicKey"`
+	AgeX25519Identity      string              `yaml:"ageX25519Identity"`
+	EtcdHealthCheck        string              `yaml:"etcdHealthCheck"`
+	EtcdDBSizeGrowthFactor float64             `yaml:"etcdDBSizeGrowthFactor"`
+	EnableCompression      bool                `yaml:"enableCompression"`
+	Compression            CompressionConfig   `yaml:"compression"`
+	DisableEncryption      bool                `yaml:"disableEncryption"`
+	BackupMachineConfigs   bool                `yaml:"backupMachineConfigs"`
+	PushgatewayURL         string              `yaml:"pushgatewayURL"`
+	MetricsAddress         string              `yaml:"metricsAddress"`
+	LogFormat              string              `yaml:"logFormat"`
+	LogLevel               string              `yaml:"logLevel"`
+	Webhook                WebhookConfig       `yaml:"webhook"`
+	Heartbeat              HeartbeatConfig     `yaml:"heartbeat"`
+	Kubernetes             KubernetesConfig    `yaml:"kubernetes"`
+	Server                 ServerConfig        `yaml:"server"`
+	Lock                   LockConfig          `yaml:"lock"`
+	Retry                  RetryConfig         `yaml:"retry"`
+	Multipart              MultipartConfig     `yaml:"multipart"`
+	RateLimit              RateLimitConfig     `yaml:"rateLimit"`
+	AssumeRole             AssumeRoleConfig    `yaml:"assumeRole"`
+	S3Credentials          S3CredentialsConfig `yaml:"s3Credentials"`
+	S3TLS                  S3TLSConfig         `yaml:"s3TLS"`
+	S3Endpoint             S3EndpointConfig    `yaml:"s3Endpoint"`
+	HTTP                   HTTPConfig          `yaml:"http"`
+	BackupSecrets          bool                `yaml:"backupSecrets"`
+	VerifyUpload           bool                `yaml:"verifyUpload"`
 }
 
 const (
-	customS3EndpointEnvVar   = "CUSTOM_S3_ENDPOINT"
-	bucketEnvVar             = "BUCKET"
-	regionEnvVar             = "AWS_REGION"
-	s3PrefixEnvVar           = "S3_PREFIX"
-	clusterNameEnvVar        = "CLUSTER_NAME"
-	enableCompressionEnvVar  = "ENABLE_COMPRESSION"
-	disableEncryptionEnvVar  = "DISABLE_ENCRYPTION"
-	ageX25519PublicKeyEnvVar = "AGE_X25519_PUBLIC_KEY"
+	customS3EndpointEnvVar       = "CUSTOM_S3_ENDPOINT"
+	bucketEnvVar                 = "BUCKET"
+	regionEnvVar                 = "AWS_REGION"
+	s3PrefixEnvVar               = "S3_PREFIX"
+	clusterNameEnvVar            = "CLUSTER_NAME"
+	enableCompressionEnvVar      = "ENABLE_COMPRESSION"
+	compressionLevelEnvVar       = "COMPRESSION_LEVEL"
+	compressionConcurrencyEnvVar = "COMPRESSION_CONCURRENCY"
+	compressionLongEnvVar        = "COMPRESSION_LONG"
+	compressionWindowSizeEnvVar  = "COMPRESSION_WINDOW_SIZE"
+	disableEncryptionEnvVar      = "DISABLE_ENCRYPTION"
+	ageX25519PublicKeyEnvVar     = "AGE_X25519_PUBLIC_KEY"
+	ageX25519IdentityEnvVar      = "AGE_X25519_IDENTITY"
+	verifyUploadEnvVar           = "VERIFY_UPLOAD"
+	etcdHealthCheckEnvVar        = "ETCD_HEALTH_CHECK"
+	etcdDBSizeGrowthFactorEnvVar = "ETCD_DB_SIZE_GROWTH_FACTOR"
+	backupMachineConfigsEnvVar   = "BACKUP_MACHINE_CONFIGS"
+	backupSecretsEnvVar          = "BACKUP_SECRETS"
+	pushgatewayURLEnvVar         = "PUSHGATEWAY_URL"
+	metricsAddressEnvVar         = "METRICS_ADDRESS"
+	logFormatEnvVar              = "LOG_FORMAT"
+	logLevelEnvVar               = "LOG_LEVEL"
+	webhookURLsEnvVar            = "WEBHOOK_URLS"
+	webhookFormatEnvVar          = "WEBHOOK_FORMAT"
+	webhookTemplateEnvVar        = "WEBHOOK_TEMPLATE"
+	webhookSecretEnvVar          = "WEBHOOK_SECRET"
+	webhookTimeoutEnvVar         = "WEBHOOK_TIMEOUT"
+	webhookMaxRetriesEnvVar      = "WEBHOOK_MAX_RETRIES"
+	webhookOnSuccessEnvVar       = "WEBHOOK_ON_SUCCESS"
+	heartbeatURLEnvVar           = "HEARTBEAT_URL"
+	heartbeatStartURLEnvVar      = "HEARTBEAT_START_URL"
+	heartbeatFailURLEnvVar       = "HEARTBEAT_FAIL_URL"
+	heartbeatTimeoutEnvVar       = "HEARTBEAT_TIMEOUT"
+	podNameEnvVar                = "POD_NAME"
+	podNamespaceEnvVar           = "POD_NAMESPACE"
+	statusAnnotationsEnvVar      = "KUBERNETES_STATUS_ANNOTATIONS"
+	statusConfigMapEnvVar        = "KUBERNETES_STATUS_CONFIGMAP"
+	serverAddressEnvVar          = "SERVER_ADDRESS"
+	serverTokenEnvVar            = "SERVER_TOKEN"
+	lockEnabledEnvVar            = "LOCK_ENABLED"
+	lockNamespaceEnvVar          = "LOCK_NAMESPACE"
+	lockTTLEnvVar                = "LOCK_TTL"
+	lockOnContentionEnvVar       = "LOCK_ON_CONTENTION"
+	retryMaxAttemptsEnvVar       = "RETRY_MAX_ATTEMPTS"
+	retryInitialIntervalEnvVar   = "RETRY_INITIAL_INTERVAL"
+	retryMaxIntervalEnvVar       = "RETRY_MAX_INTERVAL"
+	retryDeadlineEnvVar          = "RETRY_DEADLINE"
+	multipartThresholdEnvVar     = "MULTIPART_THRESHOLD_MB"
+	multipartPartSizeEnvVar      = "MULTIPART_PART_SIZE_MB"
+	multipartConcurrencyEnvVar   = "MULTIPART_CONCURRENCY"
+	multipartStaleAfterEnvVar    = "MULTIPART_STALE_AFTER"
+	snapshotRateLimitEnvVar      = "SNAPSHOT_RATE_LIMIT"
+	uploadRateLimitEnvVar        = "UPLOAD_RATE_LIMIT"
+	assumeRoleARNEnvVar          = "AWS_ASSUME_ROLE_ARN"
+	assumeRoleExternalIDEnvVar   = "AWS_ASSUME_ROLE_EXTERNAL_ID"
+	assumeRoleSessionNameEnvVar  = "AWS_ASSUME_ROLE_SESSION_NAME"
+	assumeRoleDurationEnvVar     = "AWS_ASSUME_ROLE_DURATION"
+	awsAccessKeyIDEnvVar         = "AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyEnvVar     = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenEnvVar        = "AWS_SESSION_TOKEN"
+	s3RegionEnvVar               = "S3_REGION"
+	s3BucketLookupEnvVar         = "S3_BUCKET_LOOKUP"
+	s3DualStackEnvVar            = "S3_DUALSTACK"
+	s3FIPSEnvVar                 = "S3_FIPS"
+	s3AccelerateEnvVar           = "S3_ACCELERATE"
+	s3CAFileEnvVar               = "S3_CA_FILE"
+	s3CertFileEnvVar             = "S3_CLIENT_CERT_FILE"
+	s3KeyFileEnvVar              = "S3_CLIENT_KEY_FILE"
+	s3TLSMinVersionEnvVar        = "S3_TLS_MIN_VERSION"
+	s3InsecureSkipVerifyEnvVar   = "S3_INSECURE_SKIP_VERIFY"
+	proxyURLEnvVar               = "PROXY_URL"
+	proxyUsernameEnvVar          = "PROXY_USERNAME"
+	proxyPasswordEnvVar          = "PROXY_PASSWORD"
+	httpConnectTimeoutEnvVar     = "HTTP_CONNECT_TIMEOUT"
+	httpResponseTimeoutEnvVar    = "HTTP_RESPONSE_TIMEOUT"
+	httpKeepAliveEnvVar          = "HTTP_KEEPALIVE"
+	httpIdleConnTimeoutEnvVar    = "HTTP_IDLE_CONN_TIMEOUT"
+	httpMaxIdleConnsEnvVar       = "HTTP_MAX_IDLE_CONNS_PER_HOST"
+
+	// fileEnvVarSuffix is appended to the name of a secret environment variable to read its value from a file.
+	fileEnvVarSuffix = "_FILE"
 )
 
+const (
+	defaultEtcdDBSizeGrowthFactor = 2
+	defaultWebhookTimeout         = 30 * time.Second
+	defaultWebhookMaxRetries      = 3
+	defaultHeartbeatTimeout       = 10 * time.Second
+	defaultServerAddress          = ":8080"
+	defaultLockTTL                = time.Minute
+	minLockTTL                    = 3 * time.Second
+	defaultRetryMaxAttempts       = 3
+	defaultRetryInitialInterval   = time.Second
+	defaultRetryMaxInterval       = 30 * time.Second
+	defaultRetryDeadline          = 15 * time.Minute
+	defaultMultipartThresholdMB   = 64
+	defaultMultipartPartSizeMB    = 16
+	minMultipartPartSizeMB        = 5
+	maxMultipartThresholdMB       = 5 << 10
+	defaultMultipartConcurrency   = 4
+	defaultMultipartStaleAfter    = 24 * time.Hour
+	defaultAssumeRoleSessionName  = "talos-backup"
+	defaultHTTPConnectTimeout     = 30 * time.Second
+	defaultHTTPResponseTimeout    = time.Minute
+	defaultHTTPKeepAlive          = 30 * time.Second
+	defaultHTTPIdleConnTimeout    = 90 * time.Second
+	defaultHTTPMaxIdleConns       = 16
+	minCompressionWindowSize      = 1 << 10
+	maxCompressionWindowSize      = 512 << 20
+	// longCompressionWindowSize is the window of long-distance matching, as used by zstd --long.
+	longCompressionWindowSize = 128 << 20
+)
+
+// secretEnvVars are the environment variables whose value may be read from a file, e.g. mounted from a Secret,
+// by setting the environment variable suffixed with _FILE to its path instead, with the field of ServiceConfig they set.
+//
+// The files are watched for changes by the Reloader.
+var secretEnvVars = []struct {
+	field func(*ServiceConfig) *string
+	name  string
+}{
+	{name: ageX25519PublicKeyEnvVar, field: func(c *ServiceConfig) *string { return &c.AgeX25519PublicKey }},
+	{name: ageX25519IdentityEnvVar, field: func(c *ServiceConfig) *string { return &c.AgeX25519Identity }},
+	{name: webhookSecretEnvVar, field: func(c *ServiceConfig) *string { return &c.Webhook.Secret }},
+	{name: serverTokenEnvVar, field: func(c *ServiceConfig) *string { return &c.Server.Token }},
+	{name: awsAccessKeyIDEnvVar, field: func(c *ServiceConfig) *string { return &c.S3Credentials.AccessKeyID }},
+	{name: awsSecretAccessKeyEnvVar, field: func(c *ServiceConfig) *string { return &c.S3Credentials.SecretAccessKey }},
+	{name: awsSessionTokenEnvVar, field: func(c *ServiceConfig) *string { return &c.S3Credentials.SessionToken }},
+	{name: proxyPasswordEnvVar, field: func(c *ServiceConfig) *string { return &c.HTTP.ProxyPassword }},
+}
+
 // GetServiceConfig parses the backup service config at path.
-func GetServiceConfig() *ServiceConfig {
-	return &ServiceConfig{
-		CustomS3Endpoint:   os.Getenv(customS3EndpointEnvVar),
-		Bucket:             os.Getenv(bucketEnvVar),
-		Region:             os.Getenv(regionEnvVar),
-		S3Prefix:           os.Getenv(s3PrefixEnvVar),
-		ClusterName:        os.Getenv(clusterNameEnvVar),
-		EnableCompression:  os.Getenv(enableCompressionEnvVar) == "true",
-		DisableEncryption:  os.Getenv(disableEncryptionEnvVar) == "true",
-		AgeX25519PublicKey: os.Getenv(ageX25519PublicKeyEnvVar),
+func GetServiceConfig() (*ServiceConfig, error) {
+	serviceConfig := &ServiceConfig{
+		CustomS3Endpoint:       os.Getenv(customS3EndpointEnvVar),
+		Bucket:                 os.Getenv(bucketEnvVar),
+		Region:                 os.Getenv(regionEnvVar),
+		S3Prefix:               os.Getenv(s3PrefixEnvVar),
+		ClusterName:            os.Getenv(clusterNameEnvVar),
+		EnableCompression:      os.Getenv(enableCompressionEnvVar) == "true",
+		DisableEncryption:      os.Getenv(disableEncryptionEnvVar) == "true",
+		VerifyUpload:           os.Getenv(verifyUploadEnvVar) == "true",
+		EtcdHealthCheck:        os.Getenv(etcdHealthCheckEnvVar),
+		EtcdDBSizeGrowthFactor: defaultEtcdDBSizeGrowthFactor,
+		BackupMachineConfigs:   os.Getenv(backupMachineConfigsEnvVar) == "true",
+		BackupSecrets:          os.Getenv(backupSecretsEnvVar) == "true",
+		PushgatewayURL:         os.Getenv(pushgatewayURLEnvVar),
+		MetricsAddress:         os.Getenv(metricsAddressEnvVar),
+		LogFormat:              os.Getenv(logFormatEnvVar),
+		LogLevel:               os.Getenv(logLevelEnvVar),
+		Webhook: WebhookConfig{
+			URLs:      getList(webhookURLsEnvVar),
+			Format:    os.Getenv(webhookFormatEnvVar),
+			Template:  os.Getenv(webhookTemplateEnvVar),
+			OnSuccess: os.Getenv(webhookOnSuccessEnvVar) == "true",
+		},
+		Heartbeat: HeartbeatConfig{
+			URL:      os.Getenv(heartbeatURLEnvVar),
+			StartURL: os.Getenv(heartbeatStartURLEnvVar),
+			FailURL:  os.Getenv(heartbeatFailURLEnvVar),
+		},
+		Kubernetes: KubernetesConfig{
+			PodName:           os.Getenv(podNameEnvVar),
+			Namespace:         os.Getenv(podNamespaceEnvVar),
+			StatusConfigMap:   os.Getenv(statusConfigMapEnvVar),
+			StatusAnnotations: os.Getenv(statusAnnotationsEnvVar) == "true",
+		},
+		Server: ServerConfig{
+			Address: os.Getenv(serverAddressEnvVar),
+		},
+		S3Endpoint: S3EndpointConfig{
+			Region:       os.Getenv(s3RegionEnvVar),
+			BucketLookup: os.Getenv(s3BucketLookupEnvVar),
+			DualStack:    os.Getenv(s3DualStackEnvVar) != "false",
+			FIPS:         os.Getenv(s3FIPSEnvVar) == "true",
+			Accelerate:   os.Getenv(s3AccelerateEnvVar) == "true",
+		},
+		S3TLS: S3TLSConfig{
+			CAFile:             os.Getenv(s3CAFileEnvVar),
+			CertFile:           os.Getenv(s3CertFileEnvVar),
+			KeyFile:            os.Getenv(s3KeyFileEnvVar),
+			InsecureSkipVerify: os.Getenv(s3InsecureSkipVerifyEnvVar) == "true",
+		},
+		Compression: CompressionConfig{
+			Level: os.Getenv(compressionLevelEnvVar),
+		},
+		HTTP: HTTPConfig{
+			ProxyURL:      os.Getenv(proxyURLEnvVar),
+			ProxyUsername: os.Getenv(proxyUsernameEnvVar),
+		},
+		AssumeRole: AssumeRoleConfig{
+			RoleARN:     os.Getenv(assumeRoleARNEnvVar),
+			ExternalID:  os.Getenv(assumeRoleExternalIDEnvVar),
+			SessionName: os.Getenv(assumeRoleSessionNameEnvVar),
+		},
+		Lock: LockConfig{
+			Enabled:      os.Getenv(lockEnabledEnvVar) == "true",
+			Namespace:    os.Getenv(lockNamespaceEnvVar),
+			OnContention: os.Getenv(lockOnContentionEnvVar),
+		},
+	}
+
+	var err error
+
+	for _, secret := range secretEnvVars {
+		if *secret.field(serviceConfig), err = getSecret(secret.name); err != nil {
+			return nil, err
+		}
+	}
+
+	if serviceConfig.Server.Address == "" {
+		serviceConfig.Server.Address = defaultServerAddress
+	}
+
+	switch serviceConfig.Webhook.Format {
+	case "", WebhookFormatGeneric, WebhookFormatSlack, WebhookFormatTeams, WebhookFormatDiscord:
+	default:
+		return nil, fmt.Errorf("invalid %s %q", webhookFormatEnvVar, serviceConfig.Webhook.Format)
+	}
+
+	if serviceConfig.Webhook.Timeout, err = getDuration(webhookTimeoutEnvVar, defaultWebhookTimeout); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.Webhook.MaxRetries, err = getInt(webhookMaxRetriesEnvVar, defaultWebhookMaxRetries); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.Heartbeat.Timeout, err = getDuration(heartbeatTimeoutEnvVar, defaultHeartbeatTimeout); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.Lock.Namespace == "" {
+		serviceConfig.Lock.Namespace = serviceConfig.Kubernetes.Namespace
+	}
+
+	serviceConfig.Lock.Identity = serviceConfig.Kubernetes.PodName
+
+	if serviceConfig.Lock.TTL, err = getDuration(lockTTLEnvVar, defaultLockTTL); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.Lock.TTL < minLockTTL {
+		return nil, fmt.Errorf("invalid %s %s: must be at least %s", lockTTLEnvVar, serviceConfig.Lock.TTL, minLockTTL)
+	}
+
+	switch serviceConfig.Lock.OnContention {
+	case "":
+		serviceConfig.Lock.OnContention = LockFail
+	case LockSkip, LockWait, LockFail:
+	default:
+		return nil, fmt.Errorf("invalid %s %q", lockOnContentionEnvVar, serviceConfig.Lock.OnContention)
+	}
+
+	if serviceConfig.Retry.MaxAttempts, err = getInt(retryMaxAttemptsEnvVar, defaultRetryMaxAttempts); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.Retry.MaxAttempts < 1 {
+		return nil, fmt.Errorf("invalid %s %d: must be at least 1", retryMaxAttemptsEnvVar, serviceConfig.Retry.MaxAttempts)
+	}
+
+	if serviceConfig.Retry.InitialInterval, err = getDuration(retryInitialIntervalEnvVar, defaultRetryInitialInterval); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.Retry.MaxInterval, err = getDuration(retryMaxIntervalEnvVar, defaultRetryMaxInterval); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.Retry.Deadline, err = getDuration(retryDeadlineEnvVar, defaultRetryDeadline); err != nil {
+		return nil, err
+	}
+
+	if err = getMultipartConfig(&serviceConfig.Multipart); err != nil {
+		return nil, err
+	}
+
+	if err = getCompressionConfig(&serviceConfig.Compression); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.RateLimit.Snapshot, err = getBytes(snapshotRateLimitEnvVar); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.RateLimit.Upload, err = getBytes(uploadRateLimitEnvVar); err != nil {
+		return nil, err
+	}
+
+	if serviceConfig.AssumeRole.SessionName == "" {
+		serviceConfig.AssumeRole.SessionName = defaultAssumeRoleSessionName
+	}
+
+	// zero leaves the duration to STS, which defaults to an hour
+	if serviceConfig.AssumeRole.Duration, err = getDuration(assumeRoleDurationEnvVar, 0); err != nil {
+		return nil, err
+	}
+
+	switch serviceConfig.S3Endpoint.BucketLookup {
+	case "":
+		serviceConfig.S3Endpoint.BucketLookup = BucketLookupAuto
+	case BucketLookupAuto, BucketLookupPath, BucketLookupVirtualHost:
+	default:
+		return nil, fmt.Errorf("invalid %s %q", s3BucketLookupEnvVar, serviceConfig.S3Endpoint.BucketLookup)
+	}
+
+	if serviceConfig.S3Endpoint.Accelerate {
+		if serviceConfig.S3Endpoint.FIPS {
+			return nil, fmt.Errorf("%s and %s are mutually exclusive", s3AccelerateEnvVar, s3FIPSEnvVar)
+		}
+
+		if serviceConfig.S3Endpoint.BucketLookup == BucketLookupPath {
+			return nil, fmt.Errorf("%s requires virtual-host bucket lookup", s3AccelerateEnvVar)
+		}
+	}
+
+	if (serviceConfig.S3TLS.CertFile == "") != (serviceConfig.S3TLS.KeyFile == "") {
+		return nil, fmt.Errorf("%s and %s must be set together", s3CertFileEnvVar, s3KeyFileEnvVar)
+	}
+
+	if serviceConfig.S3TLS.CAFile != "" && serviceConfig.S3TLS.InsecureSkipVerify {
+		return nil, fmt.Errorf("%s and %s are mutually exclusive", s3CAFileEnvVar, s3InsecureSkipVerifyEnvVar)
 	}
+
+	switch version := os.Getenv(s3TLSMinVersionEnvVar); version {
+	case "", "1.2":
+		serviceConfig.S3TLS.MinVersion = tls.VersionTLS12
+	case "1.3":
+		serviceConfig.S3TLS.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid %s %q: must be 1.2 or 1.3", s3TLSMinVersionEnvVar, version)
+	}
+
+	if err = getHTTPConfig(&serviceConfig.HTTP); err != nil {
+		return nil, err
+	}
+
+	switch serviceConfig.EtcdHealthCheck {
+	case "":
+		serviceConfig.EtcdHealthCheck = HealthCheckEnforce
+	case HealthCheckEnforce, HealthCheckWarn, HealthCheckDisabled:
+	default:
+		return nil, fmt.Errorf("invalid %s %q", etcdHealthCheckEnvVar, serviceConfig.EtcdHealthCheck)
+	}
+
+	if value := os.Getenv(etcdDBSizeGrowthFactorEnvVar); value != "" {
+		factor, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", etcdDBSizeGrowthFactorEnvVar, value, err)
+		}
+
+		serviceConfig.EtcdDBSizeGrowthFactor = factor
+	}
+
+	return serviceConfig, nil
+}
+
+// WithDefaults returns c with the defaults applied to its zero fields, e.g. of a ServiceConfig not built by GetServiceConfig.
+func (c MultipartConfig) WithDefaults() MultipartConfig {
+	if c.Threshold == 0 {
+		c.Threshold = defaultMultipartThresholdMB << 20
+	}
+
+	if c.PartSize == 0 {
+		c.PartSize = defaultMultipartPartSizeMB << 20
+	}
+
+	if c.Concurrency == 0 {
+		c.Concurrency = defaultMultipartConcurrency
+	}
+
+	return c
+}
+
+func getMultipartConfig(multipartConfig *MultipartConfig) error {
+	thresholdMB, err := getInt(multipartThresholdEnvVar, defaultMultipartThresholdMB)
+	if err != nil {
+		return err
+	}
+
+	// objects below the threshold are uploaded in a single request, which S3 limits to 5 GiB
+	if thresholdMB < 1 || thresholdMB > maxMultipartThresholdMB {
+		return fmt.Errorf("invalid %s %d: must be between 1 and %d", multipartThresholdEnvVar, thresholdMB, maxMultipartThresholdMB)
+	}
+
+	partSizeMB, err := getInt(multipartPartSizeEnvVar, defaultMultipartPartSizeMB)
+	if err != nil {
+		return err
+	}
+
+	if partSizeMB < minMultipartPartSizeMB {
+		return fmt.Errorf("invalid %s %d: must be at least %d", multipartPartSizeEnvVar, partSizeMB, minMultipartPartSizeMB)
+	}
+
+	multipartConfig.Threshold = int64(thresholdMB) << 20
+	multipartConfig.PartSize = int64(partSizeMB) << 20
+
+	if multipartConfig.Concurrency, err = getInt(multipartConcurrencyEnvVar, defaultMultipartConcurrency); err != nil {
+		return err
+	}
+
+	if multipartConfig.Concurrency < 1 {
+		return fmt.Errorf("invalid %s %d: must be at least 1", multipartConcurrencyEnvVar, multipartConfig.Concurrency)
+	}
+
+	multipartConfig.StaleAfter, err = getDuration(multipartStaleAfterEnvVar, defaultMultipartStaleAfter)
+
+	return err
+}
+
+func getCompressionConfig(compressionConfig *CompressionConfig) error {
+	switch compressionConfig.Level {
+	case "":
+		compressionConfig.Level = CompressionLevelDefault
+	case CompressionLevelFastest, CompressionLevelDefault, CompressionLevelBetter, CompressionLevelBest:
+	default:
+		return fmt.Errorf("invalid %s %q: must be fastest, default, better or best", compressionLevelEnvVar, compressionConfig.Level)
+	}
+
+	var err error
+
+	if compressionConfig.Concurrency, err = getInt(compressionConcurrencyEnvVar, 0); err != nil {
+		return err
+	}
+
+	if compressionConfig.Concurrency < 0 {
+		return fmt.Errorf("invalid %s %d: must not be negative", compressionConcurrencyEnvVar, compressionConfig.Concurrency)
+	}
+
+	if compressionConfig.WindowSize, err = getBytes(compressionWindowSizeEnvVar); err != nil {
+		return err
+	}
+
+	if compressionConfig.WindowSize == 0 && os.Getenv(compressionLongEnvVar) == "true" {
+		compressionConfig.WindowSize = longCompressionWindowSize
+	}
+
+	if size := compressionConfig.WindowSize; size != 0 && (size < minCompressionWindowSize || size > maxCompressionWindowSize || size&(size-1) != 0) {
+		return fmt.Errorf("invalid %s %d: must be a power of two between 1Ki and 512Mi", compressionWindowSizeEnvVar, size)
+	}
+
+	return nil
+}
+
+func getHTTPConfig(httpConfig *HTTPConfig) error {
+	if httpConfig.ProxyURL != "" {
+		proxyURL, err := url.Parse(httpConfig.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", proxyURLEnvVar, err)
+		}
+
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("invalid %s %q: scheme must be http, https or socks5", proxyURLEnvVar, proxyURL.Redacted())
+		}
+
+		if proxyURL.Host == "" {
+			return fmt.Errorf("invalid %s %q: missing host", proxyURLEnvVar, proxyURL.Redacted())
+		}
+	}
+
+	if httpConfig.ProxyPassword != "" && httpConfig.ProxyUsername == "" {
+		return fmt.Errorf("%s requires %s", proxyPasswordEnvVar, proxyUsernameEnvVar)
+	}
+
+	var err error
+
+	if httpConfig.ConnectTimeout, err = getDuration(httpConnectTimeoutEnvVar, defaultHTTPConnectTimeout); err != nil {
+		return err
+	}
+
+	if httpConfig.ResponseTimeout, err = getDuration(httpResponseTimeoutEnvVar, defaultHTTPResponseTimeout); err != nil {
+		return err
+	}
+
+	if httpConfig.KeepAlive, err = getDuration(httpKeepAliveEnvVar, defaultHTTPKeepAlive); err != nil {
+		return err
+	}
+
+	if httpConfig.IdleConnTimeout, err = getDuration(httpIdleConnTimeoutEnvVar, defaultHTTPIdleConnTimeout); err != nil {
+		return err
+	}
+
+	if httpConfig.MaxIdleConnsPerHost, err = getInt(httpMaxIdleConnsEnvVar, defaultHTTPMaxIdleConns); err != nil {
+		return err
+	}
+
+	if httpConfig.MaxIdleConnsPerHost < 1 {
+		return fmt.Errorf("invalid %s %d: must be at least 1", httpMaxIdleConnsEnvVar, httpConfig.MaxIdleConnsPerHost)
+	}
+
+	return nil
+}
+
+// getSecret returns the value of the environment variable name, or the contents of the file named by name suffixed with _FILE.
+func getSecret(name string) (string, error) {
+	path := os.Getenv(name + fileEnvVarSuffix)
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+
+	if os.Getenv(name) != "" {
+		return "", fmt.Errorf("only one of %s and %s may be set", name, name+fileEnvVarSuffix)
+	}
+
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name+fileEnvVarSuffix, err)
+	}
+
+	return strings.TrimSpace(string(value)), nil
+}
+
+// getList returns the comma separated values of the environment variable name.
+func getList(name string) []string {
+	var values []string
+
+	for value := range strings.SplitSeq(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// getDuration parses the environment variable name as a duration, returning def if it is not set.
+func getDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+
+	return d, nil
+}
+
+// getBytes parses the environment variable name as a quantity of bytes such as 10Mi or 500k, returning zero if it is not set.
+func getBytes(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+
+	if quantity.Sign() < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", name, value)
+	}
+
+	return quantity.Value(), nil
+}
+
+// getInt parses the environment variable name as an integer, returning def if it is not set.
+func getInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+
+	return i, nil
 }
@@ -0,0 +1,148 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGetSecret can't run in parallel as it sets the environment.
+func TestGetSecret(t *testing.T) {
+	dir := t.TempDir()
+
+	secretPath := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secretPath, []byte("from-file\n"), 0o600))
+
+	for _, test := range []struct {
+		name        string
+		value       string
+		file        string
+		expected    string
+		expectedErr string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:     "plain",
+			value:    "plain",
+			expected: "plain",
+		},
+		{
+			name:     "file with trailing newline",
+			file:     secretPath,
+			expected: "from-file",
+		},
+		{
+			name:        "plain and file",
+			value:       "plain",
+			file:        secretPath,
+			expectedErr: "only one of SERVER_TOKEN and SERVER_TOKEN_FILE may be set",
+		},
+		{
+			name:        "missing file",
+			file:        filepath.Join(dir, "missing"),
+			expectedErr: "failed to read SERVER_TOKEN_FILE",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(serverTokenEnvVar, test.value)
+			t.Setenv(serverTokenEnvVar+fileEnvVarSuffix, test.file)
+
+			value, err := getSecret(serverTokenEnvVar)
+
+			if test.expectedErr != "" {
+				require.ErrorContains(t, err, test.expectedErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, value)
+		})
+	}
+}
+
+// TestGetCompressionConfig can't run in parallel as it sets the environment.
+func TestGetCompressionConfig(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		level       string
+		windowSize  string
+		long        string
+		expectedErr string
+		expected    CompressionConfig
+	}{
+		{
+			name:     "defaults",
+			expected: CompressionConfig{Level: CompressionLevelDefault},
+		},
+		{
+			name:     "level",
+			level:    CompressionLevelBest,
+			expected: CompressionConfig{Level: CompressionLevelBest},
+		},
+		{
+			name:        "unknown level",
+			level:       "ultra",
+			expectedErr: `invalid COMPRESSION_LEVEL "ultra"`,
+		},
+		{
+			name:       "window size",
+			windowSize: "1Mi",
+			expected:   CompressionConfig{Level: CompressionLevelDefault, WindowSize: 1 << 20},
+		},
+		{
+			name:     "long",
+			long:     "true",
+			expected: CompressionConfig{Level: CompressionLevelDefault, WindowSize: longCompressionWindowSize},
+		},
+		{
+			name:       "window size overrides long",
+			windowSize: "64Ki",
+			long:       "true",
+			expected:   CompressionConfig{Level: CompressionLevelDefault, WindowSize: 64 << 10},
+		},
+		{
+			name:        "window size not a power of two",
+			windowSize:  "1000",
+			expectedErr: "invalid COMPRESSION_WINDOW_SIZE 1000",
+		},
+		{
+			name:        "window size too small",
+			windowSize:  "512",
+			expectedErr: "invalid COMPRESSION_WINDOW_SIZE 512",
+		},
+		{
+			name:        "window size too large",
+			windowSize:  "1Gi",
+			expectedErr: "invalid COMPRESSION_WINDOW_SIZE 1073741824",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(compressionConcurrencyEnvVar, "")
+			t.Setenv(compressionWindowSizeEnvVar, test.windowSize)
+			t.Setenv(compressionLongEnvVar, test.long)
+
+			compressionConfig := CompressionConfig{Level: test.level}
+
+			err := getCompressionConfig(&compressionConfig)
+
+			if test.expectedErr != "" {
+				assert.ErrorContains(t, err, test.expectedErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, compressionConfig)
+		})
+	}
+}
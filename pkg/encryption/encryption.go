@@ -6,6 +6,7 @@
 package encryption
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -16,11 +17,11 @@ import (
 )
 
 // EncryptFile encrypts a file with an age X25519 public key.
-func EncryptFile(fileToEncryptPath, publicKey string) (string, error) {
+func EncryptFile(ctx context.Context, fileToEncryptPath, publicKey string) (string, error) {
 	encryptedFileName, err := encryptFile(fileToEncryptPath, publicKey)
 
 	if err != nil && encryptedFileName != "" {
-		util.CleanupFile(encryptedFileName)
+		util.CleanupFile(ctx, encryptedFileName)
 	}
 
 	return encryptedFileName, err
@@ -68,3 +69,18 @@ func encryptFile(fileToEncryptPath, publicKey string) (string, error) {
 
 	return encryptedFileName, nil
 }
+
+// NewDecryptingReader returns a reader decrypting src with an age X25519 identity.
+func NewDecryptingReader(src io.Reader, identity string) (io.Reader, error) {
+	x25519Identity, err := age.ParseX25519Identity(identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity: %w", err)
+	}
+
+	r, err := age.Decrypt(src, x25519Identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	return r, nil
+}
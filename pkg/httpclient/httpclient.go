@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package httpclient provides the HTTP transport for outgoing requests, honoring the proxy and timeout configuration.
+package httpclient
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+)
+
+const (
+	tlsHandshakeTimeout   = 10 * time.Second
+	expectContinueTimeout = 10 * time.Second
+	maxIdleConns          = 256
+)
+
+// New returns an HTTP client using a transport created by NewTransport.
+func New(httpConfig config.HTTPConfig) *http.Client {
+	return &http.Client{Transport: NewTransport(httpConfig)}
+}
+
+// NewTransport returns an HTTP transport with the proxy, timeouts and keep-alive of httpConfig.
+//
+// Requests go through PROXY_URL if set, or through HTTPS_PROXY or HTTP_PROXY otherwise, unless excluded by NO_PROXY.
+func NewTransport(httpConfig config.HTTPConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   httpConfig.ConnectTimeout,
+		KeepAlive: httpConfig.KeepAlive,
+	}
+
+	return &http.Transport{
+		Proxy:                 proxyFunc(httpConfig),
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   httpConfig.MaxIdleConnsPerHost,
+		IdleConnTimeout:       httpConfig.IdleConnTimeout,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: httpConfig.ResponseTimeout,
+		ExpectContinueTimeout: expectContinueTimeout,
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+}
+
+// proxyFunc returns the proxy selection of httpConfig, authenticating to the proxy with the configured credentials.
+func proxyFunc(httpConfig config.HTTPConfig) func(*http.Request) (*url.URL, error) {
+	proxyConfig := httpproxy.FromEnvironment()
+
+	if httpConfig.ProxyURL != "" {
+		proxyConfig.HTTPProxy = httpConfig.ProxyURL
+		proxyConfig.HTTPSProxy = httpConfig.ProxyURL
+	}
+
+	proxyForURL := proxyConfig.ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		// the instance metadata and pod identity endpoints are never reached through a proxy
+		if ip := net.ParseIP(req.URL.Hostname()); ip != nil && ip.IsLinkLocalUnicast() {
+			return nil, nil //nolint:nilnil
+		}
+
+		proxyURL, err := proxyForURL(req.URL)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		if proxyURL.User == nil && httpConfig.ProxyUsername != "" {
+			authenticated := *proxyURL
+			authenticated.User = url.UserPassword(httpConfig.ProxyUsername, httpConfig.ProxyPassword)
+
+			proxyURL = &authenticated
+		}
+
+		return proxyURL, nil
+	}
+}
@@ -0,0 +1,290 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package lock provides a Kubernetes Lease based lock preventing overlapping backups of a cluster.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+var (
+	// ErrLocked is returned if the lock is held by another backup and the contention action is to fail.
+	ErrLocked = errors.New("another backup of the cluster is running")
+	// ErrSkipped is returned if the lock is held by another backup and the contention action is to skip.
+	ErrSkipped = errors.New("skipped as another backup of the cluster is running")
+	// ErrLost is the cause of the cancellation of the context returned by Acquire if the lock is lost.
+	ErrLost = errors.New("lost the backup lock")
+
+	errTakenOver = errors.New("the lease was taken over by another backup")
+)
+
+// waitInterval is the interval at which a held lock is polled when waiting for it.
+const waitInterval = 5 * time.Second
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+type lease struct {
+	client       coordinationclientv1.LeaseInterface
+	name         string
+	identity     string
+	ttl          time.Duration
+	waitInterval time.Duration
+}
+
+// Acquire acquires the lock for cluster, waiting for it, failing or skipping as configured if it is held by another backup.
+//
+// The lock is renewed in the background until the returned function is called to release it.
+// If it can't be renewed, the returned context is canceled with ErrLost as the cause.
+func Acquire(ctx context.Context, lockConfig config.LockConfig, cluster string) (context.Context, func(), error) {
+	if lockConfig.Namespace == "" {
+		return nil, nil, errors.New("the backup lock requires the LOCK_NAMESPACE or POD_NAMESPACE environment variable")
+	}
+
+	identity := lockConfig.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get hostname: %w", err)
+		}
+
+		identity = hostname
+	}
+
+	// several backups may run in the same pod, e.g. the schedules of the controller, so each acquisition is distinct
+	identity += "-" + strings.ToLower(rand.Text()[:8])
+
+	// falls back to the in-cluster config if KUBECONFIG is not set
+	restConfig, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load Kubernetes config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	l := &lease{
+		client:       clientset.CoordinationV1().Leases(lockConfig.Namespace),
+		name:         leaseName(cluster),
+		identity:     identity,
+		ttl:          lockConfig.TTL,
+		waitInterval: waitInterval,
+	}
+
+	return l.acquire(ctx, lockConfig.OnContention)
+}
+
+// acquire acquires the Lease, handling contention as onContention says, and renews it in the background until released.
+func (l *lease) acquire(ctx context.Context, onContention string) (context.Context, func(), error) {
+	logger := logging.FromContext(ctx).With("lease", l.name)
+
+	for {
+		holder, acquired, err := l.tryAcquire(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to acquire lease %s: %w", l.name, err)
+		}
+
+		if acquired {
+			break
+		}
+
+		switch onContention {
+		case config.LockSkip:
+			return nil, nil, fmt.Errorf("%w (held by %s)", ErrSkipped, holder)
+		case config.LockWait:
+			logger.Info("waiting for the backup lock", "holder", holder)
+
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(l.waitInterval):
+			}
+		default:
+			return nil, nil, fmt.Errorf("%w (held by %s)", ErrLocked, holder)
+		}
+	}
+
+	logger.Debug("acquired the backup lock")
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		l.renew(lockCtx, cancel)
+	}()
+
+	return lockCtx, func() {
+		cancel(nil)
+
+		<-done
+
+		if err := l.release(context.WithoutCancel(ctx)); err != nil {
+			logger.Warn("failed to release the backup lock", logging.Error(err))
+		}
+	}, nil
+}
+
+// leaseName returns the name of the Lease of cluster.
+func leaseName(cluster string) string {
+	name := "talos-backup-" + strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(cluster), "-"), "-")
+
+	return strings.TrimRight(name[:min(len(name), 63)], "-")
+}
+
+// tryAcquire takes the Lease if it doesn't exist or has expired, returning the current holder otherwise.
+func (l *lease) tryAcquire(ctx context.Context) (string, bool, error) {
+	now := metav1.NowMicro()
+	ttlSeconds := int32(l.ttl.Seconds())
+
+	current, err := l.client.Get(ctx, l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = l.client.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: l.name},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &ttlSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return "", false, nil
+		}
+
+		return "", err == nil, err
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if holder := l.holder(current); holder != "" {
+		return holder, false, nil
+	}
+
+	current.Spec.HolderIdentity = &l.identity
+	current.Spec.LeaseDurationSeconds = &ttlSeconds
+	current.Spec.AcquireTime = &now
+	current.Spec.RenewTime = &now
+
+	// the update fails on a conflict if another backup took the lease in the meantime
+	if _, err = l.client.Update(ctx, current, metav1.UpdateOptions{}); apierrors.IsConflict(err) {
+		return "", false, nil
+	}
+
+	return "", err == nil, err
+}
+
+// holder returns the identity holding current, or an empty string if it has expired.
+func (l *lease) holder(current *coordinationv1.Lease) string {
+	if current.Spec.HolderIdentity == nil || current.Spec.RenewTime == nil || current.Spec.LeaseDurationSeconds == nil {
+		return ""
+	}
+
+	expiry := current.Spec.RenewTime.Add(time.Duration(*current.Spec.LeaseDurationSeconds) * time.Second)
+	if time.Now().After(expiry) {
+		return ""
+	}
+
+	return *current.Spec.HolderIdentity
+}
+
+// renew renews the Lease every third of its TTL until ctx is canceled.
+//
+// It calls cancel with ErrLost if the Lease was taken over or couldn't be renewed before it expired.
+func (l *lease) renew(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := l.renewOnce(ctx)
+
+		switch {
+		case err == nil:
+			renewed = time.Now()
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, errTakenOver) || time.Since(renewed) >= l.ttl:
+			logging.FromContext(ctx).Error("failed to renew the backup lock", logging.Error(err))
+
+			cancel(fmt.Errorf("%w: %w", ErrLost, err))
+
+			return
+		default:
+			logging.FromContext(ctx).Warn("failed to renew the backup lock, retrying", logging.Error(err))
+		}
+	}
+}
+
+func (l *lease) renewOnce(ctx context.Context) error {
+	current, err := l.client.Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != l.identity {
+		return errTakenOver
+	}
+
+	now := metav1.NowMicro()
+	current.Spec.RenewTime = &now
+
+	_, err = l.client.Update(ctx, current, metav1.UpdateOptions{})
+
+	return err
+}
+
+// release deletes the Lease if it is still held by us.
+func (l *lease) release(ctx context.Context) error {
+	current, err := l.client.Get(ctx, l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != l.identity {
+		return nil
+	}
+
+	err = l.client.Delete(ctx, l.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &current.ResourceVersion},
+	})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,230 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package lock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+)
+
+const testNamespace = "kube-system"
+
+// testLease returns the lease of cluster "prod" acquired as identity with ttl.
+func testLease(clientset *fake.Clientset, identity string, ttl time.Duration) *lease {
+	return &lease{
+		client:       clientset.CoordinationV1().Leases(testNamespace),
+		name:         leaseName("prod"),
+		identity:     identity,
+		ttl:          ttl,
+		waitInterval: 10 * time.Millisecond,
+	}
+}
+
+// heldLease returns a Lease of cluster "prod" held by holder, last renewed at renewed.
+func heldLease(holder string, renewed time.Time) *coordinationv1.Lease {
+	renewTime := metav1.NewMicroTime(renewed)
+	ttlSeconds := int32(15)
+
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: leaseName("prod"), Namespace: testNamespace},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &ttlSeconds,
+			AcquireTime:          &renewTime,
+			RenewTime:            &renewTime,
+		},
+	}
+}
+
+func getLease(t *testing.T, clientset *fake.Clientset) *coordinationv1.Lease {
+	t.Helper()
+
+	current, err := clientset.CoordinationV1().Leases(testNamespace).Get(t.Context(), leaseName("prod"), metav1.GetOptions{})
+	require.NoError(t, err)
+
+	return current
+}
+
+func TestLeaseName(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		cluster  string
+		expected string
+	}{
+		{cluster: "prod", expected: "talos-backup-prod"},
+		{cluster: "Prod_Cluster.example", expected: "talos-backup-prod-cluster-example"},
+		{cluster: "-edge-", expected: "talos-backup-edge"},
+		{cluster: strings.Repeat("a", 49) + "-b", expected: "talos-backup-" + strings.Repeat("a", 49)},
+	} {
+		t.Run(test.cluster, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, leaseName(test.cluster))
+		})
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	t.Parallel()
+
+	clientset := fake.NewClientset()
+
+	_, release, err := testLease(clientset, "first", time.Minute).acquire(t.Context(), config.LockFail)
+	require.NoError(t, err)
+
+	current := getLease(t, clientset)
+
+	assert.Equal(t, "first", *current.Spec.HolderIdentity)
+	assert.Equal(t, int32(60), *current.Spec.LeaseDurationSeconds)
+
+	release()
+
+	_, err = clientset.CoordinationV1().Leases(testNamespace).Get(t.Context(), leaseName("prod"), metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	// the lock can be acquired again once released
+	_, release, err = testLease(clientset, "second", time.Minute).acquire(t.Context(), config.LockFail)
+	require.NoError(t, err)
+
+	release()
+}
+
+func TestAcquireExpired(t *testing.T) {
+	t.Parallel()
+
+	clientset := fake.NewClientset(heldLease("crashed", time.Now().Add(-time.Minute)))
+
+	_, release, err := testLease(clientset, "first", time.Minute).acquire(t.Context(), config.LockFail)
+	require.NoError(t, err)
+
+	defer release()
+
+	assert.Equal(t, "first", *getLease(t, clientset).Spec.HolderIdentity)
+}
+
+func TestAcquireContention(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		expectedErr  error
+		name         string
+		onContention string
+	}{
+		{
+			name:         "fail",
+			onContention: config.LockFail,
+			expectedErr:  ErrLocked,
+		},
+		{
+			name:        "default",
+			expectedErr: ErrLocked,
+		},
+		{
+			name:         "skip",
+			onContention: config.LockSkip,
+			expectedErr:  ErrSkipped,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			clientset := fake.NewClientset(heldLease("other", time.Now()))
+
+			_, _, err := testLease(clientset, "first", time.Minute).acquire(t.Context(), test.onContention)
+			require.ErrorIs(t, err, test.expectedErr)
+			assert.ErrorContains(t, err, "held by other")
+
+			// the Lease of the other backup is left alone
+			assert.Equal(t, "other", *getLease(t, clientset).Spec.HolderIdentity)
+		})
+	}
+}
+
+func TestAcquireWait(t *testing.T) {
+	t.Parallel()
+
+	clientset := fake.NewClientset()
+
+	_, releaseOther, err := testLease(clientset, "other", time.Minute).acquire(t.Context(), config.LockFail)
+	require.NoError(t, err)
+
+	time.AfterFunc(50*time.Millisecond, releaseOther)
+
+	_, release, err := testLease(clientset, "first", time.Minute).acquire(t.Context(), config.LockWait)
+	require.NoError(t, err)
+
+	defer release()
+
+	assert.Equal(t, "first", *getLease(t, clientset).Spec.HolderIdentity)
+}
+
+func TestAcquireWaitCanceled(t *testing.T) {
+	t.Parallel()
+
+	clientset := fake.NewClientset(heldLease("other", time.Now()))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := testLease(clientset, "first", time.Minute).acquire(ctx, config.LockWait)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRenew(t *testing.T) {
+	t.Parallel()
+
+	clientset := fake.NewClientset()
+
+	lockCtx, release, err := testLease(clientset, "first", 300*time.Millisecond).acquire(t.Context(), config.LockFail)
+	require.NoError(t, err)
+
+	defer release()
+
+	acquired := getLease(t, clientset).Spec.RenewTime.Time
+
+	assert.Eventually(t, func() bool {
+		return getLease(t, clientset).Spec.RenewTime.After(acquired)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, lockCtx.Err())
+}
+
+func TestTakeover(t *testing.T) {
+	t.Parallel()
+
+	clientset := fake.NewClientset()
+
+	lockCtx, release, err := testLease(clientset, "first", 300*time.Millisecond).acquire(t.Context(), config.LockFail)
+	require.NoError(t, err)
+
+	// another backup takes over the Lease, e.g. as it expired while the API server was unreachable
+	_, err = clientset.CoordinationV1().Leases(testNamespace).Update(t.Context(), heldLease("other", time.Now()), metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	select {
+	case <-lockCtx.Done():
+	case <-time.After(time.Second):
+		require.FailNow(t, "the lock context was not canceled")
+	}
+
+	assert.ErrorIs(t, context.Cause(lockCtx), ErrLost)
+
+	// releasing the lost lock leaves the Lease of the other backup alone
+	release()
+
+	assert.Equal(t, "other", *getLease(t, clientset).Spec.HolderIdentity)
+}
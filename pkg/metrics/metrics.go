@@ -0,0 +1,179 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package metrics provides Prometheus metrics for the backup service.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// Backup stages.
+const (
+	StageHealthCheck    = "health_check"
+	StageSnapshot       = "snapshot"
+	StageCompress       = "compress"
+	StageEncrypt        = "encrypt"
+	StageUpload         = "upload"
+	StageVerify         = "verify"
+	StageMachineConfigs = "machine_configs"
+	StageSecrets        = "secrets"
+)
+
+const namespace = "talos_backup"
+
+var (
+	// Registry holds all backup metrics.
+	Registry = prometheus.NewRegistry()
+
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful backup.",
+	}, []string{"cluster"})
+
+	lastFailure = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_failure_timestamp_seconds",
+		Help:      "Unix timestamp of the last failed backup.",
+	}, []string{"cluster"})
+
+	lastSkipped = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_skipped_timestamp_seconds",
+		Help:      "Unix timestamp of the last backup skipped as another backup of the cluster was running.",
+	}, []string{"cluster"})
+
+	snapshotSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "snapshot_size_bytes",
+		Help:      "Size of the last etcd snapshot before compression and encryption.",
+	}, []string{"cluster"})
+
+	uploadedSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "uploaded_size_bytes",
+		Help:      "Size of the last uploaded artifact.",
+	}, []string{"cluster", "artifact"})
+
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Duration of each backup stage.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"cluster", "stage"})
+
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Number of retried operations by stage.",
+	}, []string{"cluster", "stage"})
+
+	stageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Number of failed operations by stage.",
+	}, []string{"cluster", "stage"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		lastSuccess,
+		lastFailure,
+		lastSkipped,
+		snapshotSize,
+		uploadedSize,
+		stageDuration,
+		retries,
+		stageErrors,
+	)
+}
+
+// ObserveStage records the duration of a stage which started at start and counts it as failed if err is not nil.
+func ObserveStage(cluster, stage string, start time.Time, err error) {
+	stageDuration.WithLabelValues(cluster, stage).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		stageErrors.WithLabelValues(cluster, stage).Inc()
+	}
+}
+
+// ObserveRetry counts a retried operation.
+func ObserveRetry(cluster, stage string) {
+	retries.WithLabelValues(cluster, stage).Inc()
+}
+
+// ObserveSnapshotSize records the size of an etcd snapshot.
+func ObserveSnapshotSize(cluster string, size int64) {
+	snapshotSize.WithLabelValues(cluster).Set(float64(size))
+}
+
+// ObserveUploadedSize records the size of an uploaded artifact.
+func ObserveUploadedSize(cluster, artifact string, size int64) {
+	uploadedSize.WithLabelValues(cluster, artifact).Set(float64(size))
+}
+
+// ObserveResult records the outcome of a backup.
+func ObserveResult(cluster string, err error) {
+	if err != nil {
+		lastFailure.WithLabelValues(cluster).SetToCurrentTime()
+
+		return
+	}
+
+	lastSuccess.WithLabelValues(cluster).SetToCurrentTime()
+}
+
+// ObserveSkipped records a backup skipped as another backup of the cluster was running.
+func ObserveSkipped(cluster string) {
+	lastSkipped.WithLabelValues(cluster).SetToCurrentTime()
+}
+
+// Push pushes all metrics to the Pushgateway at url using client, grouped by cluster.
+func Push(ctx context.Context, client *http.Client, url, cluster string) error {
+	return push.New(url, namespace).
+		Client(client).
+		Gatherer(Registry).
+		Grouping("cluster", cluster).
+		PushContext(ctx)
+}
+
+// Serve exposes the metrics on /metrics at address until ctx is canceled.
+func Serve(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		srv.Close() //nolint:errcheck
+	}()
+
+	logging.FromContext(ctx).Info("serving metrics", "address", address)
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve metrics: %w", err)
+	}
+
+	return nil
+}
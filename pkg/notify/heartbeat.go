@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// heartbeatMaxRetries is the number of retries of a heartbeat ping.
+const heartbeatMaxRetries = 2
+
+// HeartbeatStart pings the start URL of the heartbeat monitor, if one is configured.
+func HeartbeatStart(ctx context.Context, client *http.Client, heartbeatConfig config.HeartbeatConfig) {
+	pingHeartbeat(ctx, client, heartbeatConfig, heartbeatURL(heartbeatConfig.URL, heartbeatConfig.StartURL, "start"), "")
+}
+
+// HeartbeatResult pings the success or, if err is not nil, the failure URL of the heartbeat monitor,
+// if one is configured. The failure ping carries the error text.
+func HeartbeatResult(ctx context.Context, client *http.Client, heartbeatConfig config.HeartbeatConfig, err error) {
+	if err != nil {
+		pingHeartbeat(ctx, client, heartbeatConfig, heartbeatURL(heartbeatConfig.URL, heartbeatConfig.FailURL, "fail"), err.Error())
+
+		return
+	}
+
+	pingHeartbeat(ctx, client, heartbeatConfig, heartbeatConfig.URL, "")
+}
+
+// heartbeatURL returns override if set, or base with suffix appended to its path otherwise, as used by healthchecks.io.
+func heartbeatURL(base, override, suffix string) string {
+	if override != "" || base == "" {
+		return override
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + suffix
+
+	return u.String()
+}
+
+// pingHeartbeat posts body to pingURL, logging rather than returning failures.
+func pingHeartbeat(ctx context.Context, client *http.Client, heartbeatConfig config.HeartbeatConfig, pingURL, body string) {
+	if pingURL == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, heartbeatConfig.Timeout)
+	defer cancel()
+
+	b := backoff.WithContext(backoff.WithMaxRetries(backoff.NewExponentialBackOff(), heartbeatMaxRetries), ctx)
+
+	err := backoff.Retry(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, pingURL, strings.NewReader(body))
+		if err != nil {
+			return backoff.Permanent(errors.New("invalid heartbeat URL"))
+		}
+
+		req.Header.Set("Content-Type", "text/plain")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+
+			return fmt.Errorf("heartbeat %s: %w", req.URL.Host, err)
+		}
+
+		defer resp.Body.Close() //nolint:errcheck
+
+		io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("heartbeat %s returned %s", req.URL.Host, resp.Status)
+		}
+
+		return nil
+	}, b)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to ping heartbeat", logging.Error(err))
+	}
+}
@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package notify
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+)
+
+func TestHeartbeatURL(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		base     string
+		override string
+		expected string
+	}{
+		{
+			name:     "suffix appended",
+			base:     "https://hc-ping.com/5a4e1c0e",
+			expected: "https://hc-ping.com/5a4e1c0e/start",
+		},
+		{
+			name:     "trailing slash",
+			base:     "https://hc-ping.com/5a4e1c0e/",
+			expected: "https://hc-ping.com/5a4e1c0e/start",
+		},
+		{
+			name:     "query kept",
+			base:     "https://uptime.example.com/api/push/abc?status=up",
+			expected: "https://uptime.example.com/api/push/abc/start?status=up",
+		},
+		{
+			name:     "override",
+			base:     "https://hc-ping.com/5a4e1c0e",
+			override: "https://cronitor.link/p/key/job?state=run",
+			expected: "https://cronitor.link/p/key/job?state=run",
+		},
+		{
+			name: "not configured",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, heartbeatURL(test.base, test.override, "start"))
+		})
+	}
+}
+
+func TestHeartbeatPings(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu    sync.Mutex
+		pings []string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		pings = append(pings, r.Method+" "+r.URL.Path+" "+string(body))
+
+		// fail the first ping to check that it is retried
+		if len(pings) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	heartbeatConfig := config.HeartbeatConfig{
+		URL:     server.URL + "/5a4e1c0e",
+		Timeout: 10 * time.Second,
+	}
+
+	HeartbeatStart(t.Context(), server.Client(), heartbeatConfig)
+	HeartbeatResult(t.Context(), server.Client(), heartbeatConfig, nil)
+	HeartbeatResult(t.Context(), server.Client(), heartbeatConfig, errors.New("etcd health check failed"))
+
+	assert.Equal(t, []string{
+		"POST /5a4e1c0e/start ",
+		"POST /5a4e1c0e/start ",
+		"POST /5a4e1c0e ",
+		"POST /5a4e1c0e/fail etcd health check failed",
+	}, pings)
+}
+
+func TestHeartbeatNotConfigured(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("unexpected heartbeat ping")
+	}))
+	t.Cleanup(server.Close)
+
+	HeartbeatStart(t.Context(), server.Client(), config.HeartbeatConfig{Timeout: time.Second})
+	HeartbeatResult(t.Context(), server.Client(), config.HeartbeatConfig{Timeout: time.Second}, nil)
+}
@@ -0,0 +1,260 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// Annotations and ConfigMap keys recording the last successful backup.
+const (
+	AnnotationLastSuccessKey  = "talos-backup.siderolabs.com/last-success-key"
+	AnnotationLastSuccessSize = "talos-backup.siderolabs.com/last-success-size"
+	AnnotationLastSuccessTime = "talos-backup.siderolabs.com/last-success-time"
+
+	statusKeyCluster = "cluster"
+	statusKeyKey     = "lastSuccessKey"
+	statusKeySize    = "lastSuccessSize"
+	statusKeyTime    = "lastSuccessTime"
+)
+
+// Event reasons.
+const (
+	ReasonBackupSucceeded = "BackupSucceeded"
+	ReasonBackupFailed    = "BackupFailed"
+	ReasonBackupSkipped   = "BackupSkipped"
+)
+
+const (
+	fieldManager      = "talos-backup"
+	kubernetesTimeout = 30 * time.Second
+)
+
+// RecordKubernetesEvent records event as a Kubernetes Event on the CronJob owning the pod talos-backup runs in, or on the pod itself,
+// and, if configured, records successful backups in annotations on the CronJob and in a ConfigMap.
+//
+// Nothing is recorded unless the pod name and namespace are set. Failures are logged rather than returned.
+func RecordKubernetesEvent(ctx context.Context, kubernetesConfig config.KubernetesConfig, event Event) {
+	if kubernetesConfig.PodName == "" || kubernetesConfig.Namespace == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kubernetesTimeout)
+	defer cancel()
+
+	if err := recordKubernetesEvent(ctx, kubernetesConfig, event); err != nil {
+		logging.FromContext(ctx).Error("failed to record backup in Kubernetes", logging.Error(err))
+	}
+}
+
+func recordKubernetesEvent(ctx context.Context, kubernetesConfig config.KubernetesConfig, event Event) error {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load in-cluster Kubernetes config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	object, err := involvedObject(ctx, clientset, kubernetesConfig)
+	if err != nil {
+		return err
+	}
+
+	if err = createEvent(ctx, clientset, kubernetesConfig, object, event); err != nil {
+		return err
+	}
+
+	if !event.Success {
+		return nil
+	}
+
+	if kubernetesConfig.StatusAnnotations {
+		if err = annotate(ctx, clientset, object, event); err != nil {
+			return err
+		}
+	}
+
+	if kubernetesConfig.StatusConfigMap != "" {
+		if err = writeStatusConfigMap(ctx, clientset, kubernetesConfig, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// involvedObject returns a reference to the CronJob owning the Job which owns the pod, or to the pod if it isn't run by a CronJob.
+func involvedObject(ctx context.Context, clientset kubernetes.Interface, kubernetesConfig config.KubernetesConfig) (corev1.ObjectReference, error) {
+	pod, err := clientset.CoreV1().Pods(kubernetesConfig.Namespace).Get(ctx, kubernetesConfig.PodName, metav1.GetOptions{})
+	if err != nil {
+		return corev1.ObjectReference{}, fmt.Errorf("failed to get pod %s: %w", kubernetesConfig.PodName, err)
+	}
+
+	podRef := corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  pod.Namespace,
+		Name:       pod.Name,
+		UID:        pod.UID,
+	}
+
+	jobOwner := controllerOf(pod.OwnerReferences, "Job")
+	if jobOwner == nil {
+		return podRef, nil
+	}
+
+	job, err := clientset.BatchV1().Jobs(pod.Namespace).Get(ctx, jobOwner.Name, metav1.GetOptions{})
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to get job owning the pod, recording on the pod", logging.Error(err))
+
+		return podRef, nil
+	}
+
+	cronJobOwner := controllerOf(job.OwnerReferences, "CronJob")
+	if cronJobOwner == nil {
+		return podRef, nil
+	}
+
+	return corev1.ObjectReference{
+		APIVersion: cronJobOwner.APIVersion,
+		Kind:       cronJobOwner.Kind,
+		Namespace:  pod.Namespace,
+		Name:       cronJobOwner.Name,
+		UID:        cronJobOwner.UID,
+	}, nil
+}
+
+func controllerOf(ownerReferences []metav1.OwnerReference, kind string) *metav1.OwnerReference {
+	for i := range ownerReferences {
+		if ownerReferences[i].Kind == kind && ownerReferences[i].Controller != nil && *ownerReferences[i].Controller {
+			return &ownerReferences[i]
+		}
+	}
+
+	return nil
+}
+
+func createEvent(ctx context.Context, clientset kubernetes.Interface, kubernetesConfig config.KubernetesConfig, object corev1.ObjectReference, event Event) error {
+	eventType, reason := corev1.EventTypeNormal, ReasonBackupSucceeded
+
+	switch {
+	case event.Skipped:
+		reason = ReasonBackupSkipped
+	case !event.Success:
+		eventType, reason = corev1.EventTypeWarning, ReasonBackupFailed
+	}
+
+	now := metav1.NewTime(event.Timestamp)
+
+	_, err := clientset.CoreV1().Events(object.Namespace).Create(ctx, &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", object.Name, event.Timestamp.UnixNano()),
+			Namespace: object.Namespace,
+		},
+		InvolvedObject:      object,
+		Reason:              reason,
+		Message:             event.Summary(),
+		Type:                eventType,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		Source:              corev1.EventSource{Component: fieldManager},
+		ReportingController: fieldManager,
+		ReportingInstance:   kubernetesConfig.PodName,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create event: %w", err)
+	}
+
+	return nil
+}
+
+// annotate records event in annotations on the CronJob object refers to.
+// Pods not run by a CronJob are not annotated, as their annotations would be gone with them.
+func annotate(ctx context.Context, clientset kubernetes.Interface, object corev1.ObjectReference, event Event) error {
+	if object.Kind != "CronJob" {
+		logging.FromContext(ctx).Debug("not run by a CronJob, skipping status annotations")
+
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				AnnotationLastSuccessKey:  event.ObjectKey,
+				AnnotationLastSuccessSize: strconv.FormatInt(event.Size, 10),
+				AnnotationLastSuccessTime: event.Timestamp.UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = clientset.BatchV1().CronJobs(object.Namespace).Patch(ctx, object.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("failed to annotate %s %s: %w", object.Kind, object.Name, err)
+	}
+
+	return nil
+}
+
+// writeStatusConfigMap records event in the status ConfigMap, creating it if it doesn't exist.
+//
+// The ConfigMap is read and updated rather than server-side applied, so that the Role can restrict
+// get and update to the ConfigMap by name while create is granted separately.
+func writeStatusConfigMap(ctx context.Context, clientset kubernetes.Interface, kubernetesConfig config.KubernetesConfig, event Event) error {
+	configMaps := clientset.CoreV1().ConfigMaps(kubernetesConfig.Namespace)
+	data := map[string]string{
+		statusKeyCluster: event.Cluster,
+		statusKeyKey:     event.ObjectKey,
+		statusKeySize:    strconv.FormatInt(event.Size, 10),
+		statusKeyTime:    event.Timestamp.UTC().Format(time.RFC3339),
+	}
+
+	configMap, err := configMaps.Get(ctx, kubernetesConfig.StatusConfigMap, metav1.GetOptions{})
+
+	switch {
+	case apierrors.IsNotFound(err):
+		_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      kubernetesConfig.StatusConfigMap,
+				Namespace: kubernetesConfig.Namespace,
+			},
+			Data: data,
+		}, metav1.CreateOptions{FieldManager: fieldManager})
+	case err == nil:
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+
+		maps.Copy(configMap.Data, data)
+
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{FieldManager: fieldManager})
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write status config map %s: %w", kubernetesConfig.StatusConfigMap, err)
+	}
+
+	return nil
+}
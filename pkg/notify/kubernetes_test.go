@@ -0,0 +1,304 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package notify
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+)
+
+type policyRule struct {
+	APIGroups     []string `yaml:"apiGroups"`
+	Resources     []string `yaml:"resources"`
+	ResourceNames []string `yaml:"resourceNames"`
+	Verbs         []string `yaml:"verbs"`
+}
+
+// sampleRole returns the rules of the Role in cronjob.sample.yaml.
+func sampleRole(t *testing.T) []policyRule {
+	t.Helper()
+
+	f, err := os.Open("../../cronjob.sample.yaml")
+	require.NoError(t, err)
+
+	defer f.Close() //nolint:errcheck
+
+	decoder := yaml.NewDecoder(f)
+
+	for {
+		var doc struct {
+			Kind  string       `yaml:"kind"`
+			Rules []policyRule `yaml:"rules"`
+		}
+
+		if err = decoder.Decode(&doc); errors.Is(err, io.EOF) {
+			require.FailNow(t, "no Role in cronjob.sample.yaml")
+		}
+
+		require.NoError(t, err)
+
+		if doc.Kind == "Role" {
+			return doc.Rules
+		}
+	}
+}
+
+// assertAllowed asserts that rules allow every action, matching resource names like RBAC:
+// rules with resource names never allow create, as the name of the created object isn't known when it is authorized.
+func assertAllowed(t *testing.T, rules []policyRule, actions []k8stesting.Action) {
+	t.Helper()
+
+	for _, action := range actions {
+		var name string
+
+		switch a := action.(type) {
+		case k8stesting.GetAction:
+			name = a.GetName()
+		case k8stesting.PatchAction:
+			name = a.GetName()
+		case k8stesting.UpdateAction:
+			accessor, err := meta.Accessor(a.GetObject())
+			require.NoError(t, err)
+
+			name = accessor.GetName()
+		}
+
+		allowed := slices.ContainsFunc(rules, func(rule policyRule) bool {
+			return slices.Contains(rule.APIGroups, action.GetResource().Group) &&
+				slices.Contains(rule.Resources, action.GetResource().Resource) &&
+				slices.Contains(rule.Verbs, action.GetVerb()) &&
+				(len(rule.ResourceNames) == 0 || (name != "" && slices.Contains(rule.ResourceNames, name)))
+		})
+
+		assert.True(t, allowed, "%s %s %q is not allowed by the sample Role", action.GetVerb(), action.GetResource().Resource, name)
+	}
+}
+
+func testKubernetesConfig() config.KubernetesConfig {
+	return config.KubernetesConfig{
+		PodName:         "talos-backup-29000000-abcde",
+		Namespace:       "kube-system",
+		StatusConfigMap: "talos-backup-status",
+	}
+}
+
+func successEvent() Event {
+	return Event{
+		Timestamp: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Cluster:   "prod",
+		ObjectKey: "prod/prod-2026-01-02T03:04:05Z.snap",
+		Size:      1024,
+		Success:   true,
+	}
+}
+
+func TestWriteStatusConfigMap(t *testing.T) {
+	t.Parallel()
+
+	kubernetesConfig := testKubernetesConfig()
+	clientset := fake.NewClientset()
+
+	// the first backup creates the config map
+	require.NoError(t, writeStatusConfigMap(t.Context(), clientset, kubernetesConfig, successEvent()))
+
+	configMap, err := clientset.CoreV1().ConfigMaps(kubernetesConfig.Namespace).Get(t.Context(), kubernetesConfig.StatusConfigMap, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		statusKeyCluster: "prod",
+		statusKeyKey:     "prod/prod-2026-01-02T03:04:05Z.snap",
+		statusKeySize:    "1024",
+		statusKeyTime:    "2026-01-02T03:04:05Z",
+	}, configMap.Data)
+
+	configMap.Data["note"] = "kept"
+
+	_, err = clientset.CoreV1().ConfigMaps(kubernetesConfig.Namespace).Update(t.Context(), configMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	clientset.ClearActions()
+
+	// later backups update it, keeping other keys
+	event := successEvent()
+	event.ObjectKey = "prod/prod-2026-01-02T04:04:05Z.snap"
+
+	require.NoError(t, writeStatusConfigMap(t.Context(), clientset, kubernetesConfig, event))
+
+	configMap, err = clientset.CoreV1().ConfigMaps(kubernetesConfig.Namespace).Get(t.Context(), kubernetesConfig.StatusConfigMap, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "prod/prod-2026-01-02T04:04:05Z.snap", configMap.Data[statusKeyKey])
+	assert.Equal(t, "kept", configMap.Data["note"])
+}
+
+func TestWriteStatusConfigMapRBAC(t *testing.T) {
+	t.Parallel()
+
+	rules := sampleRole(t)
+	clientset := fake.NewClientset()
+
+	require.NoError(t, writeStatusConfigMap(t.Context(), clientset, testKubernetesConfig(), successEvent()))
+	require.NoError(t, writeStatusConfigMap(t.Context(), clientset, testKubernetesConfig(), successEvent()))
+
+	assert.Equal(t, []string{"get", "create", "get", "update"}, verbs(clientset.Actions()))
+	assertAllowed(t, rules, clientset.Actions())
+}
+
+func TestRecordOnCronJob(t *testing.T) {
+	t.Parallel()
+
+	kubernetesConfig := testKubernetesConfig()
+	controller := true
+
+	clientset := fake.NewClientset(
+		&batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "talos-backup", Namespace: kubernetesConfig.Namespace, UID: "cronjob-uid"},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "talos-backup-29000000",
+				Namespace: kubernetesConfig.Namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "batch/v1", Kind: "CronJob", Name: "talos-backup", UID: "cronjob-uid", Controller: &controller},
+				},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      kubernetesConfig.PodName,
+				Namespace: kubernetesConfig.Namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "batch/v1", Kind: "Job", Name: "talos-backup-29000000", Controller: &controller},
+				},
+			},
+		},
+	)
+
+	object, err := involvedObject(t.Context(), clientset, kubernetesConfig)
+	require.NoError(t, err)
+
+	assert.Equal(t, corev1.ObjectReference{
+		APIVersion: "batch/v1",
+		Kind:       "CronJob",
+		Namespace:  kubernetesConfig.Namespace,
+		Name:       "talos-backup",
+		UID:        "cronjob-uid",
+	}, object)
+
+	require.NoError(t, createEvent(t.Context(), clientset, kubernetesConfig, object, successEvent()))
+	require.NoError(t, annotate(t.Context(), clientset, object, successEvent()))
+
+	actions := clientset.Actions()
+
+	assert.Equal(t, []string{"get", "get", "create", "patch"}, verbs(actions))
+	assertAllowed(t, sampleRole(t), actions)
+
+	cronJob, err := clientset.BatchV1().CronJobs(kubernetesConfig.Namespace).Get(t.Context(), "talos-backup", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "prod/prod-2026-01-02T03:04:05Z.snap", cronJob.Annotations[AnnotationLastSuccessKey])
+
+	events, err := clientset.CoreV1().Events(kubernetesConfig.Namespace).List(t.Context(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+
+	assert.Equal(t, ReasonBackupSucceeded, events.Items[0].Reason)
+	assert.Equal(t, "CronJob", events.Items[0].InvolvedObject.Kind)
+}
+
+func TestRecordOnPod(t *testing.T) {
+	t.Parallel()
+
+	kubernetesConfig := testKubernetesConfig()
+
+	clientset := fake.NewClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: kubernetesConfig.PodName, Namespace: kubernetesConfig.Namespace},
+	})
+
+	object, err := involvedObject(t.Context(), clientset, kubernetesConfig)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Pod", object.Kind)
+
+	// pods aren't annotated, as the sample Role doesn't allow patching them
+	require.NoError(t, annotate(t.Context(), clientset, object, successEvent()))
+
+	assert.Equal(t, []string{"get"}, verbs(clientset.Actions()))
+	assertAllowed(t, sampleRole(t), clientset.Actions())
+}
+
+func TestCreateEvent(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name           string
+		expectedType   string
+		expectedReason string
+		event          Event
+	}{
+		{
+			name:           "succeeded",
+			event:          successEvent(),
+			expectedType:   corev1.EventTypeNormal,
+			expectedReason: ReasonBackupSucceeded,
+		},
+		{
+			name:           "skipped",
+			event:          Event{Timestamp: time.Now(), Cluster: "prod", Skipped: true},
+			expectedType:   corev1.EventTypeNormal,
+			expectedReason: ReasonBackupSkipped,
+		},
+		{
+			name:           "failed",
+			event:          Event{Timestamp: time.Now(), Cluster: "prod", Error: "failed to take etcd snapshot"},
+			expectedType:   corev1.EventTypeWarning,
+			expectedReason: ReasonBackupFailed,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			kubernetesConfig := testKubernetesConfig()
+			clientset := fake.NewClientset()
+			object := corev1.ObjectReference{Kind: "CronJob", Namespace: kubernetesConfig.Namespace, Name: "talos-backup"}
+
+			require.NoError(t, createEvent(t.Context(), clientset, kubernetesConfig, object, test.event))
+
+			events, err := clientset.CoreV1().Events(kubernetesConfig.Namespace).List(t.Context(), metav1.ListOptions{})
+			require.NoError(t, err)
+			require.Len(t, events.Items, 1)
+
+			assert.Equal(t, test.expectedType, events.Items[0].Type)
+			assert.Equal(t, test.expectedReason, events.Items[0].Reason)
+			assert.Equal(t, test.event.Summary(), events.Items[0].Message)
+		})
+	}
+}
+
+func verbs(actions []k8stesting.Action) []string {
+	verbs := make([]string, 0, len(actions))
+
+	for _, action := range actions {
+		verbs = append(verbs, action.GetVerb())
+	}
+
+	return verbs
+}
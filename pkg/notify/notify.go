@@ -0,0 +1,199 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package notify reports backup outcomes via webhooks, heartbeat pings and Kubernetes Events.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// SignatureHeader is the header carrying the HMAC-SHA256 signature of the payload.
+const SignatureHeader = "X-Talos-Backup-Signature-256"
+
+// Event describes the outcome of a backup.
+type Event struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Cluster   string        `json:"cluster"`
+	Error     string        `json:"error,omitempty"`
+	ObjectKey string        `json:"objectKey,omitempty"`
+	Size      int64         `json:"size,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Success   bool          `json:"success"`
+	// Skipped is true if the backup was skipped as another backup of the cluster was running.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// Summary returns a human readable description of the event.
+func (e Event) Summary() string {
+	if e.Skipped {
+		return fmt.Sprintf("talos-backup of cluster %q skipped as another backup of the cluster was running", e.Cluster)
+	}
+
+	if e.Success {
+		return fmt.Sprintf("talos-backup of cluster %q succeeded: uploaded %q (%d bytes) in %s", e.Cluster, e.ObjectKey, e.Size, e.Duration.Round(time.Second))
+	}
+
+	return fmt.Sprintf("talos-backup of cluster %q failed after %s: %s", e.Cluster, e.Duration.Round(time.Second), e.Error)
+}
+
+// Notify posts event to the configured webhooks.
+//
+// Successful and skipped backups are only notified with OnSuccess.
+// Failures are logged rather than returned, so that a broken webhook can't fail the backup.
+func Notify(ctx context.Context, client *http.Client, webhookConfig config.WebhookConfig, event Event) {
+	if len(webhookConfig.URLs) == 0 || ((event.Success || event.Skipped) && !webhookConfig.OnSuccess) {
+		return
+	}
+
+	payload, err := Payload(webhookConfig.Format, webhookConfig.Template, event)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to render webhook payload", logging.Error(err))
+
+		return
+	}
+
+	for _, webhookURL := range webhookConfig.URLs {
+		if err = post(ctx, client, webhookConfig, webhookURL, payload); err != nil {
+			logging.FromContext(ctx).Error("failed to send webhook notification", logging.Error(err))
+		}
+	}
+}
+
+// Payload renders the JSON payload of event in format.
+//
+// The generic format is the JSON encoding of the event, unless a template is given.
+func Payload(format, tmpl string, event Event) ([]byte, error) {
+	var payload any
+
+	switch format {
+	case "", config.WebhookFormatGeneric:
+		if tmpl != "" {
+			return renderTemplate(tmpl, event)
+		}
+
+		payload = event
+	case config.WebhookFormatSlack:
+		payload = map[string]any{
+			"text": event.Summary(),
+		}
+	case config.WebhookFormatDiscord:
+		payload = map[string]any{
+			"content": event.Summary(),
+		}
+	case config.WebhookFormatTeams:
+		color := "2EB886"
+		switch {
+		case event.Skipped:
+			color = "DAA038"
+		case !event.Success:
+			color = "D40E0D"
+		}
+
+		payload = map[string]any{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    event.Summary(),
+			"text":       event.Summary(),
+			"themeColor": color,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported webhook format %q", format)
+	}
+
+	return json.Marshal(payload)
+}
+
+func renderTemplate(tmpl string, event Event) ([]byte, error) {
+	t, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+
+			return string(b), err
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webhook template: %w", err)
+	}
+
+	var buf bytes.Buffer
+
+	if err = t.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("failed to render webhook template: %w", err)
+	}
+
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("webhook template did not render valid JSON")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// post sends payload to webhookURL, retrying on network errors, 429 and 5xx responses.
+//
+// Errors only mention the host of the webhook, as webhook URLs often embed a secret token.
+func post(ctx context.Context, client *http.Client, webhookConfig config.WebhookConfig, webhookURL string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookConfig.Timeout)
+	defer cancel()
+
+	b := backoff.WithContext(backoff.WithMaxRetries(backoff.NewExponentialBackOff(), uint64(webhookConfig.MaxRetries)), ctx)
+
+	return backoff.RetryNotify(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(payload))
+		if err != nil {
+			return backoff.Permanent(errors.New("invalid webhook URL"))
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		if webhookConfig.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(webhookConfig.Secret))
+			mac.Write(payload) //nolint:errcheck
+
+			req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+
+			return fmt.Errorf("webhook %s: %w", req.URL.Host, err)
+		}
+
+		defer resp.Body.Close() //nolint:errcheck
+
+		io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return fmt.Errorf("webhook %s returned %s", req.URL.Host, resp.Status)
+		default:
+			return backoff.Permanent(fmt.Errorf("webhook %s returned %s", req.URL.Host, resp.Status))
+		}
+	}, b, func(err error, delay time.Duration) {
+		logging.FromContext(ctx).Warn("webhook notification failed, retrying", logging.Error(err), "delay", delay)
+	})
+}
@@ -0,0 +1,257 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package notify_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/notify"
+)
+
+// webhookServer records the requests it receives and responds with the given status codes in turn, then 200.
+type webhookServer struct {
+	*httptest.Server
+
+	bodies     [][]byte
+	signatures []string
+	statuses   []int
+	mu         sync.Mutex
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	t.Helper()
+
+	s := &webhookServer{statuses: statuses}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.bodies = append(s.bodies, body)
+		s.signatures = append(s.signatures, r.Header.Get(notify.SignatureHeader))
+
+		if len(s.statuses) > 0 {
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+		}
+	}))
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *webhookServer) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.bodies)
+}
+
+func testEvent(success bool) notify.Event {
+	event := notify.Event{
+		Timestamp: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Cluster:   "prod",
+		Duration:  time.Minute,
+		Success:   success,
+	}
+
+	if success {
+		event.ObjectKey = "prod/prod-2026-01-02T03:04:05Z.snap"
+		event.Size = 1024
+	} else {
+		event.Error = "failed to take etcd snapshot"
+	}
+
+	return event
+}
+
+func TestNotifySignature(t *testing.T) {
+	t.Parallel()
+
+	server := newWebhookServer(t)
+
+	notify.Notify(t.Context(), server.Client(), config.WebhookConfig{
+		URLs:    []string{server.URL},
+		Secret:  "s3cr3t",
+		Timeout: 10 * time.Second,
+	}, testEvent(false))
+
+	require.Equal(t, 1, server.requests())
+
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(server.bodies[0])
+
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), server.signatures[0])
+
+	var event notify.Event
+
+	require.NoError(t, json.Unmarshal(server.bodies[0], &event))
+	assert.Equal(t, testEvent(false), event)
+}
+
+func TestNotifyRetries(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name             string
+		statuses         []int
+		maxRetries       int
+		expectedRequests int
+	}{
+		{
+			name:             "success",
+			maxRetries:       3,
+			expectedRequests: 1,
+		},
+		{
+			name:             "retried on 5xx and 429",
+			statuses:         []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			maxRetries:       3,
+			expectedRequests: 3,
+		},
+		{
+			name:             "retries exhausted",
+			statuses:         []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			maxRetries:       1,
+			expectedRequests: 2,
+		},
+		{
+			name:             "not retried on 4xx",
+			statuses:         []int{http.StatusNotFound},
+			maxRetries:       3,
+			expectedRequests: 1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := newWebhookServer(t, test.statuses...)
+
+			notify.Notify(t.Context(), server.Client(), config.WebhookConfig{
+				URLs:       []string{server.URL},
+				Timeout:    30 * time.Second,
+				MaxRetries: test.maxRetries,
+			}, testEvent(false))
+
+			assert.Equal(t, test.expectedRequests, server.requests())
+			assert.Empty(t, server.signatures[0])
+		})
+	}
+}
+
+func TestNotifyOnSuccess(t *testing.T) {
+	t.Parallel()
+
+	server := newWebhookServer(t)
+
+	webhookConfig := config.WebhookConfig{
+		URLs:    []string{server.URL},
+		Timeout: 10 * time.Second,
+	}
+
+	skipped := notify.Event{Timestamp: time.Now(), Cluster: "prod", Skipped: true}
+
+	notify.Notify(t.Context(), server.Client(), webhookConfig, testEvent(true))
+	notify.Notify(t.Context(), server.Client(), webhookConfig, skipped)
+
+	assert.Equal(t, 0, server.requests())
+
+	webhookConfig.OnSuccess = true
+
+	notify.Notify(t.Context(), server.Client(), webhookConfig, testEvent(true))
+	notify.Notify(t.Context(), server.Client(), webhookConfig, skipped)
+
+	assert.Equal(t, 2, server.requests())
+}
+
+func TestPayload(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name        string
+		format      string
+		template    string
+		expected    string
+		expectedErr string
+		skipped     bool
+	}{
+		{
+			name:     "slack",
+			format:   config.WebhookFormatSlack,
+			expected: `{"text":"talos-backup of cluster \"prod\" failed after 1m0s: failed to take etcd snapshot"}`,
+		},
+		{
+			name:     "discord",
+			format:   config.WebhookFormatDiscord,
+			expected: `{"content":"talos-backup of cluster \"prod\" failed after 1m0s: failed to take etcd snapshot"}`,
+		},
+		{
+			name:     "skipped",
+			format:   config.WebhookFormatSlack,
+			skipped:  true,
+			expected: `{"text":"talos-backup of cluster \"prod\" skipped as another backup of the cluster was running"}`,
+		},
+		{
+			name:     "generic skipped",
+			format:   config.WebhookFormatGeneric,
+			skipped:  true,
+			expected: `{"timestamp":"2026-01-02T03:04:05Z","cluster":"prod","duration":60000000000,"success":false,"skipped":true}`,
+		},
+		{
+			name:     "template",
+			format:   config.WebhookFormatGeneric,
+			template: `{"cluster":{{ json .Cluster }},"ok":{{ .Success }}}`,
+			expected: `{"cluster":"prod","ok":false}`,
+		},
+		{
+			name:        "template rendering invalid JSON",
+			template:    `{{ .Cluster }}`,
+			expectedErr: "webhook template did not render valid JSON",
+		},
+		{
+			name:        "unsupported format",
+			format:      "irc",
+			expectedErr: `unsupported webhook format "irc"`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			event := testEvent(false)
+
+			if test.skipped {
+				event = notify.Event{Timestamp: event.Timestamp, Cluster: event.Cluster, Duration: event.Duration, Skipped: true}
+			}
+
+			payload, err := notify.Payload(test.format, test.template, event)
+
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.JSONEq(t, test.expected, string(payload))
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package ratelimit provides readers limiting the bandwidth of snapshots and uploads.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxBurst limits the bytes read at once, so that the bandwidth is spread evenly.
+const maxBurst = 1 << 20
+
+// NewLimiter returns a limiter of bytesPerSecond, or nil if bytesPerSecond is zero.
+func NewLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxBurst)))
+}
+
+// NewReader returns a reader of r waiting for limiter after every read, or r if limiter is nil.
+//
+// If r is an io.Seeker, the returned reader is as well, so that the S3 client can rewind it to retry a request.
+func NewReader(ctx context.Context, r io.Reader, limiter *rate.Limiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+
+	lr := &reader{ctx: ctx, r: r, limiter: limiter}
+
+	if seeker, ok := r.(io.Seeker); ok {
+		return &readSeeker{reader: lr, seeker: seeker}
+	}
+
+	return lr
+}
+
+// BytesPerSecond returns the throughput of transferring size bytes in d.
+func BytesPerSecond(size int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return int64(float64(size) / d.Seconds())
+}
+
+type reader struct {
+	ctx     context.Context //nolint:containedctx
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+type readSeeker struct {
+	*reader
+
+	seeker io.Seeker
+}
+
+func (r *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.seeker.Seek(offset, whence)
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package retry retries operations failing with transient errors with exponential backoff.
+package retry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+type observerKey struct{}
+
+// WithObserver returns a copy of ctx in which Do calls observe before every retry, e.g. to count retries by stage.
+func WithObserver(ctx context.Context, observe func()) context.Context {
+	return context.WithValue(ctx, observerKey{}, observe)
+}
+
+// Do calls op until it succeeds, fails with an error retryable doesn't accept, the attempts are exhausted or the deadline passes.
+//
+// The deadline only prevents retries from starting after it, an attempt in progress is not interrupted,
+// so that a long transfer, e.g. limited in bandwidth, isn't canceled and started over while it is making progress.
+// Each failed attempt which is going to be retried is logged with the name of the operation and reported to the observer of ctx.
+func Do(ctx context.Context, retryConfig config.RetryConfig, name string, retryable func(error) bool, op func(context.Context) error) error {
+	expBackoff := backoff.NewExponentialBackOff(
+		backoff.WithInitialInterval(retryConfig.InitialInterval),
+		backoff.WithMaxInterval(retryConfig.MaxInterval),
+		backoff.WithMaxElapsedTime(retryConfig.Deadline),
+	)
+
+	b := backoff.WithContext(backoff.WithMaxRetries(expBackoff, uint64(max(retryConfig.MaxAttempts-1, 0))), ctx)
+
+	attempt := 0
+
+	return backoff.RetryNotify(func() error {
+		attempt++
+
+		err := op(ctx)
+		if err != nil && !retryable(err) {
+			return backoff.Permanent(err)
+		}
+
+		return err
+	}, b, func(err error, delay time.Duration) {
+		if observe, ok := ctx.Value(observerKey{}).(func()); ok {
+			observe()
+		}
+
+		logging.FromContext(ctx).Warn(name+" failed, retrying", "attempt", attempt, "max_attempts", retryConfig.MaxAttempts, "delay", delay, logging.Error(err))
+	})
+}
+
+// IsNetworkError returns true if err is a network error such as a connection reset or a timeout, which are worth retrying.
+//
+// Certificate verification failures and canceled requests are not, even though HTTP clients report them as network errors.
+func IsNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) || isCertificateError(err) {
+		return false
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr)
+}
+
+func isCertificateError(err error) bool {
+	var (
+		verificationErr     *tls.CertificateVerificationError
+		unknownAuthorityErr x509.UnknownAuthorityError
+		hostnameErr         x509.HostnameError
+		invalidErr          x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &verificationErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
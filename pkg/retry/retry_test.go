@@ -0,0 +1,259 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package retry_test
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/retry"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("permanent")
+)
+
+func testRetryConfig(maxAttempts int) config.RetryConfig {
+	return config.RetryConfig{
+		MaxAttempts:     maxAttempts,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+		Deadline:        time.Minute,
+	}
+}
+
+func alwaysRetryable(error) bool { return true }
+
+func transientOnly(err error) bool { return errors.Is(err, errTransient) }
+
+func TestDoObserver(t *testing.T) {
+	t.Parallel()
+
+	var (
+		attempts int
+		retries  int
+	)
+
+	ctx := retry.WithObserver(t.Context(), func() { retries++ })
+
+	err := retry.Do(ctx, testRetryConfig(5), "test", alwaysRetryable, func(context.Context) error {
+		if attempts++; attempts < 3 {
+			return errTransient
+		}
+
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 2, retries)
+}
+
+func TestDo(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		expectedErr      error
+		name             string
+		errs             []error
+		maxAttempts      int
+		expectedAttempts int
+	}{
+		{
+			name:             "success",
+			maxAttempts:      3,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "success after retries",
+			maxAttempts:      3,
+			errs:             []error{errTransient, errTransient},
+			expectedAttempts: 3,
+		},
+		{
+			name:             "attempts exhausted",
+			maxAttempts:      3,
+			errs:             []error{errTransient, errTransient, errTransient, errTransient},
+			expectedAttempts: 3,
+			expectedErr:      errTransient,
+		},
+		{
+			name:             "single attempt",
+			maxAttempts:      1,
+			errs:             []error{errTransient},
+			expectedAttempts: 1,
+			expectedErr:      errTransient,
+		},
+		{
+			name:             "permanent",
+			maxAttempts:      3,
+			errs:             []error{fmt.Errorf("wrapped: %w", errPermanent)},
+			expectedAttempts: 1,
+			expectedErr:      errPermanent,
+		},
+		{
+			name:             "permanent after retry",
+			maxAttempts:      5,
+			errs:             []error{errTransient, errPermanent},
+			expectedAttempts: 2,
+			expectedErr:      errPermanent,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			attempts := 0
+
+			err := retry.Do(t.Context(), testRetryConfig(test.maxAttempts), "test", transientOnly, func(context.Context) error {
+				attempts++
+
+				if attempts <= len(test.errs) {
+					return test.errs[attempts-1]
+				}
+
+				return nil
+			})
+
+			assert.Equal(t, test.expectedAttempts, attempts)
+
+			if test.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, test.expectedErr)
+			}
+		})
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	attempts := 0
+
+	err := retry.Do(ctx, testRetryConfig(5), "test", alwaysRetryable, func(context.Context) error {
+		attempts++
+
+		cancel()
+
+		return errTransient
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDoDeadline(t *testing.T) {
+	t.Parallel()
+
+	retryConfig := testRetryConfig(5)
+	retryConfig.Deadline = 20 * time.Millisecond
+
+	attempts := 0
+
+	err := retry.Do(t.Context(), retryConfig, "test", alwaysRetryable, func(ctx context.Context) error {
+		attempts++
+
+		// an attempt outlasting the deadline is not interrupted by it
+		time.Sleep(50 * time.Millisecond)
+
+		require.NoError(t, ctx.Err())
+
+		return errTransient
+	})
+
+	assert.ErrorIs(t, err, errTransient)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestIsNetworkError(t *testing.T) {
+	t.Parallel()
+
+	urlError := func(err error) error {
+		return &url.Error{Op: "Put", URL: "https://s3.example.com/bucket/key", Err: err}
+	}
+
+	for _, test := range []struct {
+		err      error
+		name     string
+		expected bool
+	}{
+		{
+			name:     "connection reset",
+			err:      urlError(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}),
+			expected: true,
+		},
+		{
+			name:     "bare connection reset",
+			err:      fmt.Errorf("failed to upload: %w", syscall.ECONNRESET),
+			expected: true,
+		},
+		{
+			name:     "connection refused",
+			err:      &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			expected: true,
+		},
+		{
+			name:     "broken pipe",
+			err:      os.NewSyscallError("write", syscall.EPIPE),
+			expected: true,
+		},
+		{
+			name:     "unexpected EOF",
+			err:      fmt.Errorf("failed to read response: %w", io.ErrUnexpectedEOF),
+			expected: true,
+		},
+		{
+			name:     "timeout",
+			err:      urlError(context.DeadlineExceeded),
+			expected: true,
+		},
+		{
+			name:     "DNS",
+			err:      &net.DNSError{Err: "no such host", Name: "s3.example.com", IsTemporary: true},
+			expected: true,
+		},
+		{
+			name: "unknown authority",
+			err:  urlError(x509.UnknownAuthorityError{}),
+		},
+		{
+			name: "hostname mismatch",
+			err:  urlError(x509.HostnameError{Host: "s3.example.com", Certificate: &x509.Certificate{}}),
+		},
+		{
+			name: "canceled",
+			err:  urlError(context.Canceled),
+		},
+		{
+			name: "other",
+			err:  errPermanent,
+		},
+		{
+			name: "EOF",
+			err:  io.EOF,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, retry.IsNetworkError(test.err))
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"context"
+	"crypto/md5" //nolint:gosec
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// ErrChecksumMismatch is returned if the checksum of an uploaded object or part doesn't match the local file.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumType is the additional checksum sent along with uploads, which S3 verifies against the body and stores with the object.
+const checksumType = minio.ChecksumSHA256
+
+// sums holds the checksums of a file or a part of it.
+type sums struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// sectionSums returns the checksums of size bytes of f starting at offset.
+func sectionSums(f *os.File, offset, size int64) (sums, error) {
+	md5Hash := md5.New() //nolint:gosec
+	sha256Hash := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), io.NewSectionReader(f, offset, size)); err != nil {
+		return sums{}, fmt.Errorf("failed to checksum %q: %w", f.Name(), err)
+	}
+
+	return sums{md5: md5Hash.Sum(nil), sha256: sha256Hash.Sum(nil)}, nil
+}
+
+// fileSums returns the SHA-256 checksum of the first size bytes of f and the checksums of its parts of partSize bytes.
+func fileSums(f *os.File, size, partSize int64) ([]byte, []sums, error) {
+	fileHash := sha256.New()
+	parts := make([]sums, 0, (size+partSize-1)/partSize)
+
+	for offset := int64(0); offset < size; offset += partSize {
+		md5Hash := md5.New() //nolint:gosec
+		sha256Hash := sha256.New()
+
+		if _, err := io.Copy(io.MultiWriter(fileHash, md5Hash, sha256Hash), io.NewSectionReader(f, offset, min(partSize, size-offset))); err != nil {
+			return nil, nil, fmt.Errorf("failed to checksum %q: %w", f.Name(), err)
+		}
+
+		parts = append(parts, sums{md5: md5Hash.Sum(nil), sha256: sha256Hash.Sum(nil)})
+	}
+
+	return fileHash.Sum(nil), parts, nil
+}
+
+func (s sums) md5Base64() string {
+	return base64.StdEncoding.EncodeToString(s.md5)
+}
+
+func (s sums) sha256Base64() string {
+	return base64.StdEncoding.EncodeToString(s.sha256)
+}
+
+// matches returns an error if the SHA-256 checksum reported by S3 doesn't match s, unless none was reported.
+func (s sums) matches(checksumSHA256 string) error {
+	if checksumSHA256 != "" && checksumSHA256 != s.sha256Base64() {
+		return fmt.Errorf("%w: expected SHA-256 %s, got %s", ErrChecksumMismatch, s.sha256Base64(), checksumSHA256)
+	}
+
+	return nil
+}
+
+// objectChecksum is the checksum S3 reports for an uploaded object.
+type objectChecksum struct {
+	// sha256 is base64 encoded, for multipart uploads it is the checksum of the part checksums.
+	sha256 string
+	// etag is the MD5 checksum of the object, it is empty for multipart uploads whose ETag isn't one.
+	etag string
+}
+
+// singleChecksum returns the checksum of an object uploaded in a single request.
+func singleChecksum(s sums) objectChecksum {
+	return objectChecksum{
+		sha256: s.sha256Base64(),
+		etag:   hex.EncodeToString(s.md5),
+	}
+}
+
+// multipartChecksum returns the checksum of an object uploaded in parts with the given checksums.
+func multipartChecksum(parts []sums) objectChecksum {
+	sha256Hash := sha256.New()
+
+	for _, part := range parts {
+		sha256Hash.Write(part.sha256)
+	}
+
+	return objectChecksum{
+		sha256: base64.StdEncoding.EncodeToString(sha256Hash.Sum(nil)),
+	}
+}
+
+// verifyChecksum reads back the checksum of the uploaded object and compares it with expected.
+//
+// Objects without an additional checksum whose ETag isn't their MD5 checksum can't be verified, which is logged.
+func verifyChecksum(ctx context.Context, s3c *minio.Client, bucket, key string, size int64, expected objectChecksum) error {
+	info, err := s3c.StatObject(ctx, bucket, key, minio.StatObjectOptions{Checksum: true})
+	if err != nil {
+		return fmt.Errorf("failed to read back the checksum of %q: %w", key, err)
+	}
+
+	if info.Size != size {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrChecksumMismatch, size, info.Size)
+	}
+
+	// the checksum of a multipart upload may be suffixed with the number of parts
+	if checksum, _, _ := strings.Cut(info.ChecksumSHA256, "-"); checksum != "" {
+		if checksum != expected.sha256 {
+			return fmt.Errorf("%w: expected SHA-256 %s, got %s", ErrChecksumMismatch, expected.sha256, checksum)
+		}
+
+		return nil
+	}
+
+	etag, ok := etagMD5(info.ETag, info.Metadata)
+	if !ok || expected.etag == "" {
+		logging.FromContext(ctx).Warn("the object store reported no checksum, the upload could not be verified", logging.KeyObjectKey, key)
+
+		return nil
+	}
+
+	if !strings.EqualFold(etag, expected.etag) {
+		return fmt.Errorf("%w: expected ETag %s, got %s", ErrChecksumMismatch, expected.etag, etag)
+	}
+
+	return nil
+}
+
+// etagMD5 returns the ETag S3 reported along with header if it is an MD5 checksum.
+//
+// The ETag of encrypted objects and of multipart uploads is opaque, so it is only used
+// if there are no server-side encryption headers and it is 32 hex digits without a part count.
+func etagMD5(etag string, header http.Header) (string, bool) {
+	for name := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "X-Amz-Server-Side-Encryption") {
+			return "", false
+		}
+	}
+
+	etag = strings.Trim(etag, `"`)
+
+	return etag, isMD5Hex(etag)
+}
+
+func isMD5Hex(s string) bool {
+	decoded, err := hex.DecodeString(s)
+
+	return err == nil && len(decoded) == md5.Size
+}
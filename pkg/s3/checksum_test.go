@@ -0,0 +1,195 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"crypto/md5" //nolint:gosec
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sumsOf(data string) sums {
+	md5Sum := md5.Sum([]byte(data)) //nolint:gosec
+	sha256Sum := sha256.Sum256([]byte(data))
+
+	return sums{md5: md5Sum[:], sha256: sha256Sum[:]}
+}
+
+func TestSectionSums(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	require.NoError(t, os.WriteFile(path, []byte("headerbodytrailer"), 0o600))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer f.Close() //nolint:errcheck
+
+	s, err := sectionSums(f, 6, 4)
+	require.NoError(t, err)
+	assert.Equal(t, sumsOf("body"), s)
+}
+
+func TestSingleChecksum(t *testing.T) {
+	t.Parallel()
+
+	md5Sum := md5.Sum([]byte("snapshot")) //nolint:gosec
+	sha256Sum := sha256.Sum256([]byte("snapshot"))
+
+	assert.Equal(t, objectChecksum{
+		sha256: base64.StdEncoding.EncodeToString(sha256Sum[:]),
+		etag:   hex.EncodeToString(md5Sum[:]),
+	}, singleChecksum(sumsOf("snapshot")))
+}
+
+func TestMultipartChecksum(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name  string
+		parts []string
+	}{
+		{
+			name:  "single part",
+			parts: []string{"snapshot"},
+		},
+		{
+			name:  "three parts",
+			parts: []string{"first", "second", "third"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				parts   []sums
+				sha256s []byte
+			)
+
+			for _, part := range test.parts {
+				s := sumsOf(part)
+
+				parts = append(parts, s)
+				sha256s = append(sha256s, s.sha256...)
+			}
+
+			sha256Sum := sha256.Sum256(sha256s)
+
+			checksum := multipartChecksum(parts)
+
+			assert.Equal(t, base64.StdEncoding.EncodeToString(sha256Sum[:]), checksum.sha256)
+			// the ETag of a multipart upload isn't an MD5 checksum
+			assert.Empty(t, checksum.etag)
+
+			// the checksum of the parts is not the checksum of the whole object
+			assert.NotEqual(t, singleChecksum(sumsOf(strings.Join(test.parts, ""))).sha256, checksum.sha256)
+		})
+	}
+}
+
+func TestSumsMatches(t *testing.T) {
+	t.Parallel()
+
+	s := sumsOf("snapshot")
+
+	assert.NoError(t, s.matches(""))
+	assert.NoError(t, s.matches(s.sha256Base64()))
+	assert.ErrorIs(t, s.matches(sumsOf("other").sha256Base64()), ErrChecksumMismatch)
+}
+
+func TestETagMD5(t *testing.T) {
+	t.Parallel()
+
+	md5Hex := hex.EncodeToString(sumsOf("snapshot").md5)
+
+	for _, test := range []struct {
+		header   http.Header
+		name     string
+		etag     string
+		expected string
+	}{
+		{
+			name:     "etag",
+			etag:     md5Hex,
+			expected: md5Hex,
+		},
+		{
+			name:     "quoted etag",
+			etag:     `"` + md5Hex + `"`,
+			expected: md5Hex,
+		},
+		{
+			name:     "uppercase etag",
+			etag:     strings.ToUpper(md5Hex),
+			expected: strings.ToUpper(md5Hex),
+		},
+		{
+			name:     "unrelated headers",
+			etag:     md5Hex,
+			header:   http.Header{"Content-Type": {"application/octet-stream"}},
+			expected: md5Hex,
+		},
+		{
+			name: "multipart etag",
+			etag: `"` + md5Hex + `-3"`,
+		},
+		{
+			name: "opaque etag",
+			etag: `"` + strings.Repeat("a", 64) + `"`,
+		},
+		{
+			name:   "sse-kms etag",
+			etag:   `"` + md5Hex + `"`,
+			header: http.Header{"X-Amz-Server-Side-Encryption": {"aws:kms"}, "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": {"key"}},
+		},
+		{
+			name:   "sse-c etag",
+			etag:   `"` + md5Hex + `"`,
+			header: http.Header{"x-amz-server-side-encryption-customer-algorithm": {"AES256"}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			etag, ok := etagMD5(test.etag, test.header)
+
+			assert.Equal(t, test.expected != "", ok)
+
+			if ok {
+				assert.Equal(t, test.expected, etag)
+			}
+		})
+	}
+}
+
+func TestIsMD5Hex(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		s        string
+		expected bool
+	}{
+		{s: hex.EncodeToString(sumsOf("snapshot").md5), expected: true},
+		{s: strings.ToUpper(hex.EncodeToString(sumsOf("snapshot").md5)), expected: true},
+		{s: ""},
+		{s: strings.Repeat("a", 31)},
+		{s: strings.Repeat("a", 34)},
+		{s: strings.Repeat("g", 32)},
+		{s: hex.EncodeToString(sumsOf("snapshot").md5) + "-2"},
+	} {
+		assert.Equal(t, test.expected, isMD5Hex(test.s), test.s)
+	}
+}
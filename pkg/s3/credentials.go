@@ -0,0 +1,168 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awscredentials "github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	buconfig "github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/httpclient"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+const (
+	// credentialsTimeout limits the time spent retrieving credentials, e.g. from STS or the instance metadata service.
+	credentialsTimeout = 30 * time.Second
+	// credentialsExpiryWindow is how long before their expiry credentials are refreshed.
+	credentialsExpiryWindow = time.Minute
+)
+
+// awsProvider adapts the credentials resolved by the AWS SDK to a minio credentials provider.
+type awsProvider struct {
+	// ctx bounds refreshing the credentials, as minio doesn't pass a context to providers;
+	// it is the context the S3 client was created with.
+	ctx      context.Context //nolint:containedctx
+	provider aws.CredentialsProvider
+	expires  time.Time
+	mu       sync.Mutex
+
+	retrieved bool
+	canExpire bool
+}
+
+// newCredentials returns the credentials of the default AWS credential chain, assuming the configured role if any.
+//
+// The chain covers environment variables, web identity tokens such as EKS IRSA (AWS_WEB_IDENTITY_TOKEN_FILE),
+// shared config and credentials file profiles (AWS_PROFILE) including role_arn and source_profile, SSO, and the
+// ECS and EC2 metadata services. Static credentials read from the environment or from files take precedence over it.
+// The credentials are retrieved once to fail early and to log the chosen provider and their source.
+func newCredentials(ctx context.Context, svcConf *buconfig.ServiceConfig) (*credentials.Credentials, error) {
+	// STS is reached through the configured proxy as well
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithHTTPClient(httpclient.New(svcConf.HTTP)),
+	}
+
+	if svcConf.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(svcConf.Region))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+
+	logger := logging.FromContext(ctx)
+	providerName := "default chain"
+
+	if static := svcConf.S3Credentials; static.AccessKeyID != "" || static.SecretAccessKey != "" {
+		providerName = "static"
+		cfg.Credentials = awscredentials.NewStaticCredentialsProvider(static.AccessKeyID, static.SecretAccessKey, static.SessionToken)
+
+		for _, envVar := range []string{"AWS_PROFILE", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+			if os.Getenv(envVar) != "" {
+				logger.Warn("ignoring "+envVar+" as static S3 credentials are configured", "env", envVar)
+			}
+		}
+	}
+
+	if assumeRole := svcConf.AssumeRole; assumeRole.RoleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), assumeRole.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = assumeRole.SessionName
+			o.Duration = assumeRole.Duration
+
+			if assumeRole.ExternalID != "" {
+				o.ExternalID = aws.String(assumeRole.ExternalID)
+			}
+		}))
+	}
+
+	provider := &awsProvider{ctx: ctx, provider: cfg.Credentials}
+
+	retrieveCtx, cancel := context.WithTimeout(ctx, credentialsTimeout)
+	defer cancel()
+
+	creds, err := provider.retrieve(retrieveCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+
+	attrs := []any{"provider", providerName, "source", creds.Source, "access_key_id", creds.AccessKeyID}
+
+	if svcConf.AssumeRole.RoleARN != "" {
+		attrs = append(attrs, "assume_role", true, "role_arn", svcConf.AssumeRole.RoleARN, "session_name", svcConf.AssumeRole.SessionName)
+	}
+
+	if creds.CanExpire {
+		attrs = append(attrs, "expires", creds.Expires)
+	}
+
+	logger.Info("S3 credentials resolved", attrs...)
+
+	return credentials.New(provider), nil
+}
+
+func (p *awsProvider) retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := p.provider.Retrieve(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.retrieved = true
+	p.canExpire = creds.CanExpire
+	p.expires = creds.Expires
+
+	return creds, nil
+}
+
+// RetrieveWithCredContext implements credentials.Provider.
+func (p *awsProvider) RetrieveWithCredContext(*credentials.CredContext) (credentials.Value, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, credentialsTimeout)
+	defer cancel()
+
+	creds, err := p.retrieve(ctx)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	value := credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}
+
+	if creds.CanExpire {
+		value.Expiration = creds.Expires
+	}
+
+	return value, nil
+}
+
+// Retrieve implements credentials.Provider.
+func (p *awsProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithCredContext(nil)
+}
+
+// IsExpired implements credentials.Provider.
+func (p *awsProvider) IsExpired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return !p.retrieved || p.canExpire && time.Now().Add(credentialsExpiryWindow).After(p.expires)
+}
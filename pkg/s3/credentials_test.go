@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSProviderRetrieve(t *testing.T) {
+	t.Parallel()
+
+	expires := time.Now().Add(time.Hour)
+
+	provider := &awsProvider{
+		ctx: t.Context(),
+		provider: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "key", SecretAccessKey: "secret", SessionToken: "token", CanExpire: true, Expires: expires}, nil
+		}),
+	}
+
+	assert.True(t, provider.IsExpired())
+
+	value, err := provider.Retrieve()
+	require.NoError(t, err)
+
+	assert.Equal(t, "key", value.AccessKeyID)
+	assert.Equal(t, "secret", value.SecretAccessKey)
+	assert.Equal(t, "token", value.SessionToken)
+	assert.Equal(t, expires, value.Expiration)
+	assert.False(t, provider.IsExpired())
+}
+
+func TestAWSProviderRetrieveCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	provider := &awsProvider{
+		ctx: ctx,
+		provider: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			<-ctx.Done()
+
+			return aws.Credentials{}, ctx.Err()
+		}),
+	}
+
+	cancel()
+
+	// refreshing the credentials is canceled along with the context the client was created with
+	_, err := provider.Retrieve()
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,118 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+
+	buconfig "github.com/siderolabs/talos-backup/pkg/config"
+)
+
+const (
+	defaultAWSRegion = "us-east-1"
+	// awsAccelerateEndpoint is the endpoint of S3 Transfer Acceleration, for buckets with it enabled.
+	awsAccelerateEndpoint          = "s3-accelerate.amazonaws.com"
+	awsAccelerateDualStackEndpoint = "s3-accelerate.dualstack.amazonaws.com"
+)
+
+// endpoint is the host and scheme of an S3 endpoint.
+type endpoint struct {
+	// host is the host with an optional port, with IPv6 literals in brackets.
+	host   string
+	secure bool
+	aws    bool
+}
+
+// resolveEndpoint returns the endpoint of svcConf: the custom endpoint if it is set, or else the AWS endpoint
+// of region in the variant selected by the endpoint options.
+func resolveEndpoint(svcConf *buconfig.ServiceConfig, region string) (endpoint, error) {
+	endpointConf := svcConf.S3Endpoint
+
+	if svcConf.CustomS3Endpoint != "" {
+		e, err := parseEndpoint(svcConf.CustomS3Endpoint)
+		if err != nil {
+			return endpoint{}, fmt.Errorf("invalid S3 endpoint %q: %w", svcConf.CustomS3Endpoint, err)
+		}
+
+		if !e.aws && (endpointConf.FIPS || endpointConf.Accelerate) {
+			return endpoint{}, errors.New("FIPS and accelerate endpoints are only available on AWS")
+		}
+
+		return e, nil
+	}
+
+	if region == "" {
+		region = defaultAWSRegion
+	}
+
+	domain := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		domain = "amazonaws.com.cn"
+	}
+
+	host := fmt.Sprintf("s3.%s.%s", region, domain)
+
+	// the host of FIPS endpoints is used as is, the others are switched to the dual-stack variant by the client
+	switch {
+	case endpointConf.FIPS && endpointConf.DualStack:
+		host = fmt.Sprintf("s3-fips.dualstack.%s.%s", region, domain)
+	case endpointConf.FIPS:
+		host = fmt.Sprintf("s3-fips.%s.%s", region, domain)
+	}
+
+	return endpoint{host: host, secure: true, aws: true}, nil
+}
+
+// parseEndpoint parses an endpoint URL, or a bare host with an optional port, which defaults to HTTPS.
+func parseEndpoint(rawEndpoint string) (endpoint, error) {
+	if !strings.Contains(rawEndpoint, "://") {
+		rawEndpoint = "https://" + rawEndpoint
+	}
+
+	u, err := url.Parse(rawEndpoint)
+	if err != nil {
+		return endpoint{}, err
+	}
+
+	var e endpoint
+
+	switch u.Scheme {
+	case "https":
+		e.secure = true
+	case "http":
+	default:
+		return endpoint{}, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return endpoint{}, errors.New("missing host")
+	}
+
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return endpoint{}, errors.New("only a scheme, host and port are supported; use S3_PREFIX for a path within the bucket")
+	}
+
+	e.host = u.Host
+	e.aws = strings.HasSuffix(u.Hostname(), ".amazonaws.com") || strings.HasSuffix(u.Hostname(), ".amazonaws.com.cn")
+
+	return e, nil
+}
+
+// bucketLookup returns the minio bucket lookup type of a bucket lookup style.
+func bucketLookup(style string) minio.BucketLookupType {
+	switch style {
+	case buconfig.BucketLookupPath:
+		return minio.BucketLookupPath
+	case buconfig.BucketLookupVirtualHost:
+		return minio.BucketLookupDNS
+	default:
+		return minio.BucketLookupAuto
+	}
+}
@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+
+	buconfig "github.com/siderolabs/talos-backup/pkg/config"
+)
+
+// dbSizeIndex records the etcd database sizes of the most recent snapshots of a cluster,
+// so that they can be read without listing the bucket.
+type dbSizeIndex struct {
+	Snapshots []indexedSnapshot `json:"snapshots"`
+}
+
+type indexedSnapshot struct {
+	Key    string `json:"key"`
+	DBSize int64  `json:"dbSize"`
+}
+
+// add appends the snapshot uploaded as key, keeping the most recent count snapshots.
+func (i *dbSizeIndex) add(key string, dbSize int64, count int) {
+	i.Snapshots = append(i.Snapshots, indexedSnapshot{Key: key, DBSize: dbSize})
+	i.Snapshots = i.Snapshots[max(0, len(i.Snapshots)-count):]
+}
+
+func (i *dbSizeIndex) dbSizes() []int64 {
+	sizes := make([]int64, 0, len(i.Snapshots))
+
+	for _, snapshot := range i.Snapshots {
+		sizes = append(sizes, snapshot.DBSize)
+	}
+
+	return sizes
+}
+
+func dbSizeIndexKey(s3Prefix, clusterName string) string {
+	return fmt.Sprintf("%s/%s.dbsizes.json", s3Prefix, clusterName)
+}
+
+// RecentSnapshotDBSizes returns the etcd database sizes of the most recent snapshots of clusterName under s3Prefix,
+// as recorded by RecordSnapshotDBSize.
+func RecentSnapshotDBSizes(ctx context.Context, conf buconfig.S3Info, s3c *minio.Client, s3Prefix, clusterName string) ([]int64, error) {
+	index, err := readDBSizeIndex(ctx, conf, s3c, dbSizeIndexKey(s3Prefix, clusterName))
+	if err != nil {
+		return nil, err
+	}
+
+	return index.dbSizes(), nil
+}
+
+// RecordSnapshotDBSize records the etcd database size of the snapshot uploaded as key in the index of the most recent count snapshots
+// of clusterName under s3Prefix.
+func RecordSnapshotDBSize(ctx context.Context, conf buconfig.S3Info, s3c *minio.Client, s3Prefix, clusterName, key string, dbSize int64, count int) error {
+	indexKey := dbSizeIndexKey(s3Prefix, clusterName)
+
+	index, err := readDBSizeIndex(ctx, conf, s3c, indexKey)
+	if err != nil {
+		return err
+	}
+
+	index.add(key, dbSize, count)
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s3c.PutObject(ctx, conf.Bucket, indexKey, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "application/json"}); err != nil {
+		return fmt.Errorf("failed to write %q: %w", indexKey, err)
+	}
+
+	return nil
+}
+
+// readDBSizeIndex reads the index at indexKey, returning an empty index if there is none yet.
+func readDBSizeIndex(ctx context.Context, conf buconfig.S3Info, s3c *minio.Client, indexKey string) (*dbSizeIndex, error) {
+	index := &dbSizeIndex{}
+
+	object, err := s3c.GetObject(ctx, conf.Bucket, indexKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", indexKey, err)
+	}
+
+	defer object.Close() //nolint:errcheck
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return index, nil
+		}
+
+		return nil, fmt.Errorf("failed to read %q: %w", indexKey, err)
+	}
+
+	if err = json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", indexKey, err)
+	}
+
+	return index, nil
+}
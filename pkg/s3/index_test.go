@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBSizeIndex(t *testing.T) {
+	t.Parallel()
+
+	index := &dbSizeIndex{}
+
+	assert.Empty(t, index.dbSizes())
+
+	for i, key := range []string{"a.snap", "b.snap", "c.snap", "d.snap"} {
+		index.add(key, int64(i+1)*100, 3)
+	}
+
+	assert.Equal(t, []int64{200, 300, 400}, index.dbSizes())
+
+	data, err := json.Marshal(index)
+	require.NoError(t, err)
+
+	var decoded dbSizeIndex
+
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, index, &decoded)
+	assert.Equal(t, "c.snap", decoded.Snapshots[1].Key)
+}
+
+func TestDBSizeIndexKey(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "backups/prod/prod.dbsizes.json", dbSizeIndexKey("backups/prod", "prod"))
+}
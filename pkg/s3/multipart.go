@@ -0,0 +1,390 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+
+	buconfig "github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+	"github.com/siderolabs/talos-backup/pkg/ratelimit"
+)
+
+// maxParts is the maximum number of parts of a multipart upload allowed by S3.
+const maxParts = 10000
+
+// uploadState is persisted next to the uploaded file so that an interrupted multipart upload can be resumed.
+//
+// It is named after the destination and the SHA-256 checksum of the file, so it is only resumed by an upload of the same content.
+type uploadState struct {
+	// Parts are the parts uploaded and verified so far, by part number.
+	Parts    map[int]uploadedPart `json:"parts,omitempty"`
+	Bucket   string               `json:"bucket"`
+	Key      string               `json:"key"`
+	SHA256   string               `json:"sha256"`
+	UploadID string               `json:"uploadId"`
+	PartSize int64                `json:"partSize"`
+}
+
+// uploadedPart is a part S3 accepted with the checksums of the local file.
+type uploadedPart struct {
+	ETag           string `json:"etag"`
+	ChecksumSHA256 string `json:"checksumSha256"`
+	Size           int64  `json:"size"`
+}
+
+// multipartUpload uploads a file in parts, resuming a previous upload of the same file if its state was persisted.
+type multipartUpload struct {
+	core      minio.Core
+	limiter   *rate.Limiter
+	f         *os.File
+	opts      minio.PutObjectOptions
+	statePath string
+	partSums  []sums
+	state     uploadState
+	config    buconfig.MultipartConfig
+	size      int64
+	mu        sync.Mutex
+}
+
+// newMultipartUpload checksums the parts of f and loads the state of a previous upload of it to bucket and key, if there is one.
+func newMultipartUpload(
+	ctx context.Context, s3c *minio.Client, multipartConfig buconfig.MultipartConfig, limiter *rate.Limiter, f *os.File, size int64, bucket, key string, opts minio.PutObjectOptions,
+) (*multipartUpload, error) {
+	partSize := max(multipartConfig.PartSize, (size+maxParts-1)/maxParts)
+
+	fileSHA256, partSums, err := fileSums(f, size, partSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// have S3 verify the SHA-256 checksum of every part, minio.Core leaves announcing the algorithm
+	// when the upload is started to the caller, so it is set in the metadata like minio does itself
+	opts.AutoChecksum = checksumType
+	opts.UserMetadata = maps.Clone(opts.UserMetadata)
+
+	if opts.UserMetadata == nil {
+		opts.UserMetadata = map[string]string{}
+	}
+
+	opts.UserMetadata["X-Amz-Checksum-Algorithm"] = opts.AutoChecksum.String()
+
+	u := &multipartUpload{
+		core:      minio.Core{Client: s3c},
+		limiter:   limiter,
+		f:         f,
+		opts:      opts,
+		statePath: statePath(f.Name(), bucket, key, fileSHA256),
+		partSums:  partSums,
+		config:    multipartConfig,
+		size:      size,
+		state: uploadState{
+			Bucket:   bucket,
+			Key:      key,
+			SHA256:   hex.EncodeToString(fileSHA256),
+			PartSize: partSize,
+		},
+	}
+
+	saved, err := u.loadState()
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		logging.FromContext(ctx).Warn("ignoring invalid multipart upload state", "path", u.statePath, logging.Error(err))
+	case saved.Bucket == bucket && saved.Key == key && saved.SHA256 == u.state.SHA256 && saved.PartSize == partSize && saved.UploadID != "":
+		u.state = saved
+	}
+
+	return u, nil
+}
+
+// statePath returns the path of the state of the upload of the file at path with the given SHA-256 checksum to bucket and key.
+func statePath(path, bucket, key string, fileSHA256 []byte) string {
+	id := sha256.Sum256([]byte(bucket + "/" + key + "@" + hex.EncodeToString(fileSHA256)))
+
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%x.upload.json", filepath.Base(path), id[:8]))
+}
+
+// upload uploads the parts which are missing or differ from the local file and completes the upload.
+//
+// It returns the checksum S3 is expected to report for the object.
+func (u *multipartUpload) upload(ctx context.Context) (minio.UploadInfo, objectChecksum, error) {
+	logger := logging.FromContext(ctx)
+
+	if u.state.UploadID == "" {
+		if err := u.start(ctx); err != nil {
+			return minio.UploadInfo{}, objectChecksum{}, err
+		}
+	}
+
+	uploaded, err := u.listParts(ctx)
+	if errResp := minio.ToErrorResponse(err); errResp.Code == "NoSuchUpload" {
+		// the upload was completed, aborted or expired in the meantime
+		logger.Warn("multipart upload not found, starting over", "upload_id", u.state.UploadID)
+
+		u.removeState(ctx)
+
+		if err = u.start(ctx); err != nil {
+			return minio.UploadInfo{}, objectChecksum{}, err
+		}
+
+		uploaded, err = u.listParts(ctx)
+	}
+
+	if err != nil {
+		return minio.UploadInfo{}, objectChecksum{}, fmt.Errorf("failed to list uploaded parts: %w", err)
+	}
+
+	u.abortStale(ctx)
+
+	numParts := len(u.partSums)
+	parts := make([]minio.CompletePart, numParts)
+
+	var (
+		mu      sync.Mutex
+		skipped int
+	)
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(u.config.Concurrency)
+
+	for partNumber := 1; partNumber <= numParts; partNumber++ {
+		eg.Go(func() error {
+			part, reused, err := u.uploadPart(egCtx, partNumber, uploaded[partNumber])
+			if err != nil {
+				return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+			}
+
+			parts[partNumber-1] = minio.CompletePart{PartNumber: partNumber, ETag: part.ETag, ChecksumSHA256: u.partSums[partNumber-1].sha256Base64()}
+
+			if reused {
+				mu.Lock()
+				skipped++
+				mu.Unlock()
+			}
+
+			return nil
+		})
+	}
+
+	if err = eg.Wait(); err != nil {
+		return minio.UploadInfo{}, objectChecksum{}, err
+	}
+
+	if skipped > 0 {
+		logger.Info("resumed multipart upload", "upload_id", u.state.UploadID, "parts", numParts, "reused_parts", skipped)
+	}
+
+	info, err := u.core.CompleteMultipartUpload(ctx, u.state.Bucket, u.state.Key, u.state.UploadID, parts, minio.PutObjectOptions{})
+	if err != nil {
+		return minio.UploadInfo{}, objectChecksum{}, fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	u.removeState(ctx)
+
+	info.Bucket = u.state.Bucket
+	info.Key = u.state.Key
+	info.Size = u.size
+
+	return info, multipartChecksum(u.partSums), nil
+}
+
+// start starts a new multipart upload and persists its state.
+func (u *multipartUpload) start(ctx context.Context) error {
+	uploadID, err := u.core.NewMultipartUpload(ctx, u.state.Bucket, u.state.Key, u.opts)
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.state.UploadID = uploadID
+	u.state.Parts = nil
+
+	return u.saveState()
+}
+
+// recordPart persists that part partNumber was uploaded, so that it is reused if the upload is resumed.
+func (u *multipartUpload) recordPart(ctx context.Context, partNumber int, part uploadedPart) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.state.Parts == nil {
+		u.state.Parts = map[int]uploadedPart{}
+	}
+
+	u.state.Parts[partNumber] = part
+
+	if err := u.saveState(); err != nil {
+		logging.FromContext(ctx).Warn("failed to save multipart upload state", logging.Error(err))
+	}
+}
+
+// recordedPart returns the part partNumber as recorded in the persisted state.
+func (u *multipartUpload) recordedPart(partNumber int) (uploadedPart, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	part, ok := u.state.Parts[partNumber]
+
+	return part, ok
+}
+
+func (u *multipartUpload) loadState() (uploadState, error) {
+	var state uploadState
+
+	data, err := os.ReadFile(u.statePath)
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+
+	return state, err
+}
+
+func (u *multipartUpload) saveState() error {
+	data, err := json.Marshal(u.state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal multipart upload state: %w", err)
+	}
+
+	if err = os.WriteFile(u.statePath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save multipart upload state: %w", err)
+	}
+
+	return nil
+}
+
+func (u *multipartUpload) removeState(ctx context.Context) {
+	if err := os.Remove(u.statePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logging.FromContext(ctx).Warn("failed to remove multipart upload state", "path", u.statePath, logging.Error(err))
+	}
+}
+
+// listParts returns the parts already uploaded, by part number.
+func (u *multipartUpload) listParts(ctx context.Context) (map[int]minio.ObjectPart, error) {
+	parts := map[int]minio.ObjectPart{}
+	marker := 0
+
+	for {
+		result, err := u.core.ListObjectParts(ctx, u.state.Bucket, u.state.Key, u.state.UploadID, marker, maxParts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, part := range result.ObjectParts {
+			parts[part.PartNumber] = part
+		}
+
+		if !result.IsTruncated {
+			return parts, nil
+		}
+
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// uploadPart uploads part partNumber, unless uploaded already holds the same content, returning whether it was reused.
+//
+// An uploaded part is reused if the persisted state records it with the same ETag, as it was verified when it was uploaded,
+// or if the checksum S3 lists for it matches; the ETag of a part alone isn't reliably its MD5 checksum.
+// The part is sent with its MD5 and SHA-256 checksums so that S3 rejects a corrupted body, and the checksum S3 returns is verified as well.
+func (u *multipartUpload) uploadPart(ctx context.Context, partNumber int, uploaded minio.ObjectPart) (minio.ObjectPart, bool, error) {
+	offset := int64(partNumber-1) * u.state.PartSize
+	size := min(u.state.PartSize, u.size-offset)
+	partSums := u.partSums[partNumber-1]
+
+	if uploaded.PartNumber == partNumber && uploaded.Size == size {
+		if recorded, ok := u.recordedPart(partNumber); ok && recorded.ETag == strings.Trim(uploaded.ETag, `"`) && recorded.ChecksumSHA256 == partSums.sha256Base64() {
+			return uploaded, true, nil
+		}
+
+		if uploaded.ChecksumSHA256 != "" && partSums.matches(uploaded.ChecksumSHA256) == nil {
+			return uploaded, true, nil
+		}
+	}
+
+	part, err := u.core.PutObjectPart(ctx, u.state.Bucket, u.state.Key, u.state.UploadID, partNumber,
+		ratelimit.NewReader(ctx, io.NewSectionReader(u.f, offset, size), u.limiter), size,
+		minio.PutObjectPartOptions{
+			Md5Base64:    partSums.md5Base64(),
+			CustomHeader: http.Header{u.opts.AutoChecksum.KeyCapitalized(): {partSums.sha256Base64()}},
+		})
+	if err != nil {
+		return minio.ObjectPart{}, false, err
+	}
+
+	if err = partSums.matches(part.ChecksumSHA256); err != nil {
+		return minio.ObjectPart{}, false, err
+	}
+
+	u.recordPart(ctx, partNumber, uploadedPart{ETag: strings.Trim(part.ETag, `"`), ChecksumSHA256: partSums.sha256Base64(), Size: size})
+
+	return part, false, nil
+}
+
+// abortStale aborts the multipart uploads under the directory of the uploaded object which were started more than StaleAfter ago.
+//
+// Such uploads are left behind by interrupted backups and are billed for their storage until aborted.
+func (u *multipartUpload) abortStale(ctx context.Context) {
+	if u.config.StaleAfter <= 0 {
+		return
+	}
+
+	logger := logging.FromContext(ctx)
+	prefix := u.state.Key[:strings.LastIndex(u.state.Key, "/")+1]
+	cutoff := time.Now().Add(-u.config.StaleAfter)
+
+	var keyMarker, uploadIDMarker string
+
+	for {
+		result, err := u.core.ListMultipartUploads(ctx, u.state.Bucket, prefix, keyMarker, uploadIDMarker, "", 1000)
+		if err != nil {
+			logger.Warn("failed to list stale multipart uploads", logging.Error(err))
+
+			return
+		}
+
+		for _, upload := range result.Uploads {
+			if upload.UploadID == u.state.UploadID || upload.Initiated.After(cutoff) {
+				continue
+			}
+
+			if err = u.core.AbortMultipartUpload(ctx, u.state.Bucket, upload.Key, upload.UploadID); err != nil {
+				logger.Warn("failed to abort stale multipart upload", logging.KeyObjectKey, upload.Key, "upload_id", upload.UploadID, logging.Error(err))
+
+				continue
+			}
+
+			logger.Info("aborted stale multipart upload", logging.KeyObjectKey, upload.Key, "upload_id", upload.UploadID, "initiated", upload.Initiated)
+		}
+
+		if !result.IsTruncated {
+			return
+		}
+
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+}
@@ -0,0 +1,341 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"bytes"
+	"crypto/md5" //nolint:gosec
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	buconfig "github.com/siderolabs/talos-backup/pkg/config"
+)
+
+type fakePart struct {
+	etag           string
+	checksumSHA256 string
+	data           []byte
+}
+
+// fakeS3 implements the multipart upload API of S3 for a single bucket.
+type fakeS3 struct {
+	uploads map[string]map[int]fakePart
+	objects map[string][]byte
+	// failPart fails uploads of the part with this number while it is set.
+	failPart int
+	// opaqueETags makes the ETags of parts opaque and leaves out their checksums, like some S3 compatible stores do.
+	opaqueETags bool
+	creates     int
+	partPuts    map[int]int
+	mu          sync.Mutex
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *minio.Client) {
+	t.Helper()
+
+	fake := &fakeS3{
+		uploads:  map[string]map[int]fakePart{},
+		objects:  map[string][]byte{},
+		partPuts: map[int]int{},
+	}
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	endpoint, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	s3c, err := minio.New(endpoint.Host, &minio.Options{
+		// anonymous requests send the parts as is, rather than in signed chunks
+		Creds:        credentials.NewStatic("", "", "", credentials.SignatureAnonymous),
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	require.NoError(t, err)
+
+	return fake, s3c
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	if uploadID != "" && f.uploads[uploadID] == nil {
+		writeXML(w, http.StatusNotFound, struct {
+			XMLName xml.Name `xml:"Error"`
+			Code    string   `xml:"Code"`
+		}{Code: "NoSuchUpload"})
+
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.creates++
+		uploadID = fmt.Sprintf("upload-%d", f.creates)
+		f.uploads[uploadID] = map[int]fakePart{}
+
+		writeXML(w, http.StatusOK, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: uploadID})
+	case r.Method == http.MethodPut && uploadID != "":
+		partNumber, _ := strconv.Atoi(query.Get("partNumber")) //nolint:errcheck
+
+		f.partPuts[partNumber]++
+
+		// not a status minio retries by itself
+		if partNumber == f.failPart {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		data, _ := io.ReadAll(r.Body)                                        //nolint:errcheck
+		part := fakePart{data: data, etag: fmt.Sprintf("%x", md5.Sum(data))} //nolint:gosec
+
+		if f.opaqueETags {
+			part.etag = rand.Text()
+		} else {
+			part.checksumSHA256 = r.Header.Get(checksumType.KeyCapitalized())
+			w.Header().Set(checksumType.KeyCapitalized(), part.checksumSHA256)
+		}
+
+		f.uploads[uploadID][partNumber] = part
+
+		w.Header().Set("ETag", `"`+part.etag+`"`)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && uploadID != "":
+		type listedPart struct {
+			ETag           string `xml:"ETag"`
+			ChecksumSHA256 string `xml:"ChecksumSHA256,omitempty"`
+			PartNumber     int    `xml:"PartNumber"`
+			Size           int    `xml:"Size"`
+		}
+
+		result := struct {
+			XMLName xml.Name     `xml:"ListPartsResult"`
+			Parts   []listedPart `xml:"Part"`
+		}{}
+
+		for _, partNumber := range slices.Sorted(maps.Keys(f.uploads[uploadID])) {
+			part := f.uploads[uploadID][partNumber]
+			result.Parts = append(result.Parts, listedPart{
+				PartNumber:     partNumber,
+				ETag:           `"` + part.etag + `"`,
+				ChecksumSHA256: part.checksumSHA256,
+				Size:           len(part.data),
+			})
+		}
+
+		writeXML(w, http.StatusOK, result)
+	case r.Method == http.MethodPost && uploadID != "":
+		var complete struct {
+			Parts []struct {
+				ETag       string `xml:"ETag"`
+				PartNumber int    `xml:"PartNumber"`
+			} `xml:"Part"`
+		}
+
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		var object bytes.Buffer
+
+		for _, completePart := range complete.Parts {
+			part := f.uploads[uploadID][completePart.PartNumber]
+			if `"`+part.etag+`"` != completePart.ETag && part.etag != completePart.ETag {
+				w.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+
+			object.Write(part.data)
+		}
+
+		f.objects[r.URL.Path] = object.Bytes()
+		delete(f.uploads, uploadID)
+
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+		writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string   `xml:"Bucket"`
+			Key     string   `xml:"Key"`
+			ETag    string   `xml:"ETag"`
+		}{Bucket: bucket, Key: key, ETag: fmt.Sprintf(`"%x-%d"`, md5.Sum(object.Bytes()), len(complete.Parts))}) //nolint:gosec
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func writeXML(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+
+	xml.NewEncoder(w).Encode(v) //nolint:errcheck,errchkjson
+}
+
+// testFile writes size random bytes to a file in a temporary directory and opens it.
+func testFile(t *testing.T, size int) (*os.File, []byte) {
+	t.Helper()
+
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { f.Close() }) //nolint:errcheck
+
+	return f, data
+}
+
+func testMultipartConfig() buconfig.MultipartConfig {
+	return buconfig.MultipartConfig{PartSize: 1024, Concurrency: 1}
+}
+
+func TestMultipartUploadResume(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name        string
+		opaqueETags bool
+	}{
+		{
+			name: "checksums",
+		},
+		{
+			name:        "opaque ETags",
+			opaqueETags: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			fake, s3c := newFakeS3(t)
+			fake.opaqueETags = test.opaqueETags
+			fake.failPart = 4
+
+			f, data := testFile(t, 5*1024+100)
+
+			upload, err := newMultipartUpload(t.Context(), s3c, testMultipartConfig(), nil, f, int64(len(data)), "backups", "prod/snapshot.db", minio.PutObjectOptions{})
+			require.NoError(t, err)
+
+			_, _, err = upload.upload(t.Context())
+			require.Error(t, err)
+
+			// the upload ID and the parts uploaded before the failure are persisted
+			saved, err := upload.loadState()
+			require.NoError(t, err)
+			assert.Equal(t, "upload-1", saved.UploadID)
+			assert.Equal(t, []int{1, 2, 3}, slices.Sorted(maps.Keys(saved.Parts)))
+
+			// the process restarts and uploads the same file again
+			fake.failPart = 0
+
+			upload, err = newMultipartUpload(t.Context(), s3c, testMultipartConfig(), nil, f, int64(len(data)), "backups", "prod/snapshot.db", minio.PutObjectOptions{})
+			require.NoError(t, err)
+
+			info, checksum, err := upload.upload(t.Context())
+			require.NoError(t, err)
+
+			assert.Equal(t, int64(len(data)), info.Size)
+			assert.Equal(t, data, fake.objects["/backups/prod/snapshot.db"])
+			assert.Equal(t, multipartChecksum(upload.partSums), checksum)
+
+			// the upload was resumed, only the parts which weren't uploaded were uploaded again
+			assert.Equal(t, 1, fake.creates)
+			assert.Equal(t, map[int]int{1: 1, 2: 1, 3: 1, 4: 2, 5: 1, 6: 1}, fake.partPuts)
+
+			// the state is removed once the upload completed
+			_, err = os.Stat(upload.statePath)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func TestMultipartUploadChangedFile(t *testing.T) {
+	t.Parallel()
+
+	fake, s3c := newFakeS3(t)
+	fake.failPart = 2
+
+	f, data := testFile(t, 3*1024)
+
+	upload, err := newMultipartUpload(t.Context(), s3c, testMultipartConfig(), nil, f, int64(len(data)), "backups", "prod/snapshot.db", minio.PutObjectOptions{})
+	require.NoError(t, err)
+
+	_, _, err = upload.upload(t.Context())
+	require.Error(t, err)
+
+	// the file is replaced by one with other content under the same name
+	fake.failPart = 0
+
+	other := slices.Clone(data)
+	other[0] ^= 0xff
+
+	require.NoError(t, os.WriteFile(f.Name(), other, 0o600))
+
+	changed, err := newMultipartUpload(t.Context(), s3c, testMultipartConfig(), nil, f, int64(len(other)), "backups", "prod/snapshot.db", minio.PutObjectOptions{})
+	require.NoError(t, err)
+
+	assert.NotEqual(t, upload.statePath, changed.statePath)
+	assert.Empty(t, changed.state.UploadID)
+
+	_, _, err = changed.upload(t.Context())
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, fake.creates)
+	assert.Equal(t, other, fake.objects["/backups/prod/snapshot.db"])
+}
+
+func TestStatePath(t *testing.T) {
+	t.Parallel()
+
+	fileSHA256, _ := hex.DecodeString("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+
+	path := statePath("/tmp/prod-2026-01-02.snap", "backups", "prod/prod-2026-01-02.snap", fileSHA256)
+
+	assert.Equal(t, "/tmp", filepath.Dir(path))
+	assert.Regexp(t, `^\.prod-2026-01-02\.snap\.[0-9a-f]{16}\.upload\.json$`, filepath.Base(path))
+
+	for _, other := range []string{
+		statePath("/tmp/prod-2026-01-02.snap", "other", "prod/prod-2026-01-02.snap", fileSHA256),
+		statePath("/tmp/prod-2026-01-02.snap", "backups", "prod/other.snap", fileSHA256),
+		statePath("/tmp/prod-2026-01-02.snap", "backups", "prod/prod-2026-01-02.snap", fileSHA256[1:]),
+	} {
+		assert.NotEqual(t, path, other)
+	}
+}
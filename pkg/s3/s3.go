@@ -7,59 +7,117 @@ package s3
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"os"
-	"strings"
 	"sync"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/time/rate"
 
 	buconfig "github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/httpclient"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+	"github.com/siderolabs/talos-backup/pkg/ratelimit"
+	"github.com/siderolabs/talos-backup/pkg/retry"
 )
 
-// CreateClientWithCustomEndpoint returns an S3 minio client that loads the default AWS configuration.
+// Object metadata keys attached to uploaded snapshots.
+const (
+	MetadataTalosNode           = "Talos-Node"
+	MetadataEtcdRevision        = "Etcd-Revision"
+	MetadataEtcdConsistentIndex = "Etcd-Consistent-Index"
+	MetadataEtcdDBSize          = "Etcd-Db-Size"
+	MetadataEtcdHealth          = "Etcd-Health"
+	MetadataCompression         = "Compression"
+	MetadataCompressionLevel    = "Compression-Level"
+	MetadataCompressionWindow   = "Compression-Window-Size"
+)
+
+// CreateClientWithCustomEndpoint returns an S3 minio client that loads the default AWS configuration and credentials.
 // You may optionally specify `customS3Endpoint` for a custom S3 API endpoint.
 func CreateClientWithCustomEndpoint(ctx context.Context, svcConf *buconfig.ServiceConfig) (*minio.Client, error) {
-	endpoint := svcConf.CustomS3Endpoint
-	if endpoint == "" {
-		endpoint = fmt.Sprintf("s3.%s.amazonaws.com", svcConf.Region)
+	region := svcConf.S3Endpoint.Region
+	if region == "" {
+		region = svcConf.Region
+	}
+
+	endpoint, err := resolveEndpoint(svcConf, region)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := newCredentials(ctx, svcConf)
+	if err != nil {
+		return nil, err
 	}
 
-	endpoint = strings.TrimPrefix(endpoint, "https://")
-	endpoint = strings.TrimPrefix(endpoint, "http://")
+	transport := httpclient.NewTransport(svcConf.HTTP)
 
-	useSSL := !strings.HasPrefix(svcConf.CustomS3Endpoint, "http://")
+	// objects must be read back as stored, for their checksums to match
+	transport.DisableCompression = true
 
-	creds := credentials.NewChainCredentials(
-		[]credentials.Provider{
-			&credentials.EnvAWS{},
-			&credentials.IAM{},
-			&credentials.FileAWSCredentials{},
-		},
-	)
+	if endpoint.secure {
+		if err = configureTLS(ctx, transport.TLSClientConfig, svcConf.S3TLS); err != nil {
+			return nil, fmt.Errorf("failed to configure S3 TLS: %w", err)
+		}
+	}
 
-	client, err := minio.New(endpoint, &minio.Options{
-		Creds:  creds,
-		Secure: useSSL,
-		Region: svcConf.Region,
+	client, err := minio.New(endpoint.host, &minio.Options{
+		Creds:        creds,
+		Secure:       endpoint.secure,
+		Region:       region,
+		BucketLookup: bucketLookup(svcConf.S3Endpoint.BucketLookup),
+		Transport:    otelhttp.NewTransport(transport),
+		// allows sending the checksum of single uploads as a trailer
+		TrailingHeaders: true,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to load S3 configuration: %w", err)
 	}
 
-	log.Printf("S3 client created for endpoint: %s, region: %s, useSSL: %v",
-		endpoint, svcConf.Region, useSSL)
+	attrs := []any{"endpoint", endpoint.host, "region", region, "use_ssl", endpoint.secure, "bucket_lookup", svcConf.S3Endpoint.BucketLookup}
+
+	if proxyURL, proxyErr := transport.Proxy(&http.Request{URL: client.EndpointURL()}); proxyErr == nil && proxyURL != nil {
+		attrs = append(attrs, "proxy", proxyURL.Redacted())
+	}
+
+	if endpoint.aws {
+		client.SetS3EnableDualstack(svcConf.S3Endpoint.DualStack)
+
+		if svcConf.S3Endpoint.Accelerate {
+			accelerateEndpoint := awsAccelerateEndpoint
+			if svcConf.S3Endpoint.DualStack {
+				accelerateEndpoint = awsAccelerateDualStackEndpoint
+			}
+
+			client.SetS3TransferAccelerate(accelerateEndpoint)
+		}
+
+		attrs = append(attrs, "dualstack", svcConf.S3Endpoint.DualStack, "fips", svcConf.S3Endpoint.FIPS, "accelerate", svcConf.S3Endpoint.Accelerate)
+	}
+
+	logging.FromContext(ctx).Info("S3 client created", attrs...)
 
 	return client, nil
 }
 
-// PushSnapshot will push the given file into s3.
-func PushSnapshot(ctx context.Context, conf buconfig.S3Info, s3c *minio.Client, s3Prefix, snapPath string) error {
+// PushSnapshot will push the given file into s3, attaching metadata to the object.
+//
+// Files of at least the multipart threshold are uploaded in parts, resuming an interrupted upload of the same file.
+// The SHA-256 checksum of the file is sent along so that S3 rejects a corrupted upload,
+// and the checksum of the object is read back before the upload is considered successful.
+// The upload is limited to rateLimit bytes per second, unless it is zero.
+func PushSnapshot(
+	ctx context.Context, conf buconfig.S3Info, retryConfig buconfig.RetryConfig, multipartConfig buconfig.MultipartConfig, rateLimit int64,
+	s3c *minio.Client, s3Prefix, snapPath string, metadata map[string]string,
+) (minio.UploadInfo, error) {
 	f, err := os.Open(snapPath)
 	if err != nil {
-		return err
+		return minio.UploadInfo{}, err
 	}
 
 	closeOnce := sync.OnceValue(f.Close)
@@ -67,24 +125,104 @@ func PushSnapshot(ctx context.Context, conf buconfig.S3Info, s3c *minio.Client,
 
 	fileInfo, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+		return minio.UploadInfo{}, fmt.Errorf("failed to get file info: %w", err)
 	}
 
 	objectKey := fmt.Sprintf("%s/%s", s3Prefix, snapPath)
 
-	log.Printf("Uploading %s (size: %d bytes) to bucket %s with key %s",
-		snapPath, fileInfo.Size(), conf.Bucket, objectKey)
+	logging.FromContext(ctx).Info("uploading snapshot",
+		"path", snapPath, logging.KeyBytes, fileInfo.Size(), "bucket", conf.Bucket, logging.KeyObjectKey, objectKey)
+
+	opts := minio.PutObjectOptions{
+		ContentType:  "application/octet-stream",
+		UserMetadata: metadata,
+	}
+
+	var info minio.UploadInfo
+
+	multipartConfig = multipartConfig.WithDefaults()
+	limiter := ratelimit.NewLimiter(rateLimit)
+
+	// the multipart upload is set up once, so that retries resume it
+	var upload *multipartUpload
+
+	if fileInfo.Size() >= multipartConfig.Threshold {
+		if upload, err = newMultipartUpload(ctx, s3c, multipartConfig, limiter, f, fileInfo.Size(), conf.Bucket, objectKey, opts); err != nil {
+			return minio.UploadInfo{}, err
+		}
+	}
+
+	err = retry.Do(ctx, retryConfig, "upload", IsRetryable, func(ctx context.Context) error {
+		var (
+			checksum objectChecksum
+			err      error
+		)
+
+		if upload != nil {
+			info, checksum, err = upload.upload(ctx)
+		} else {
+			info, checksum, err = putObject(ctx, s3c, limiter, f, fileInfo.Size(), conf.Bucket, objectKey, opts)
+		}
 
-	_, err = s3c.PutObject(ctx, conf.Bucket, objectKey, f, fileInfo.Size(), minio.PutObjectOptions{
-		ContentType: "application/octet-stream",
+		if err != nil {
+			return err
+		}
+
+		info.ChecksumSHA256 = checksum.sha256
+
+		return verifyChecksum(ctx, s3c, conf.Bucket, objectKey, fileInfo.Size(), checksum)
 	})
 	if err != nil {
-		return fmt.Errorf("failed to upload %q snapshot to s3: %w", snapPath, err)
+		return minio.UploadInfo{}, fmt.Errorf("failed to upload %q snapshot to s3: %w", snapPath, err)
 	}
 
 	if err = closeOnce(); err != nil {
-		return fmt.Errorf("failed to close snapshot file %q: %w", snapPath, err)
+		return minio.UploadInfo{}, fmt.Errorf("failed to close snapshot file %q: %w", snapPath, err)
+	}
+
+	return info, nil
+}
+
+// putObject uploads f in a single request with its SHA-256 checksum, which S3 verifies against the body.
+//
+// minio sends the checksum as a trailer of the body if the connection allows it, over plain HTTP the body is signed in chunks instead.
+func putObject(
+	ctx context.Context, s3c *minio.Client, limiter *rate.Limiter, f *os.File, size int64, bucket, key string, opts minio.PutObjectOptions,
+) (minio.UploadInfo, objectChecksum, error) {
+	fileSums, err := sectionSums(f, 0, size)
+	if err != nil {
+		return minio.UploadInfo{}, objectChecksum{}, err
+	}
+
+	opts.AutoChecksum = checksumType
+
+	info, err := minio.Core{Client: s3c}.PutObject(ctx, bucket, key, ratelimit.NewReader(ctx, io.NewSectionReader(f, 0, size), limiter), size, "", "", opts)
+	if err != nil {
+		return minio.UploadInfo{}, objectChecksum{}, err
+	}
+
+	if err = fileSums.matches(info.ChecksumSHA256); err != nil {
+		return minio.UploadInfo{}, objectChecksum{}, err
+	}
+
+	info.Size = size
+
+	return info, singleChecksum(fileSums), nil
+}
+
+// IsRetryable returns true if err is a throttling or server error of S3 or a network error.
+// Client errors such as AccessDenied and NoSuchBucket are permanent.
+func IsRetryable(err error) bool {
+	var errResp minio.ErrorResponse
+
+	if errors.As(err, &errResp) {
+		switch errResp.Code {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout", "RequestTimeTooSkewed", "InternalError", "ServiceUnavailable":
+			return true
+		}
+
+		return errResp.StatusCode == http.StatusTooManyRequests || errResp.StatusCode >= http.StatusInternalServerError
 	}
 
-	return nil
+	return errors.Is(err, ErrChecksumMismatch) || retry.IsNetworkError(err)
 }
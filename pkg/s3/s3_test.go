@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/siderolabs/talos-backup/pkg/s3"
+)
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+
+	errorResponse := func(statusCode int, code string) error {
+		return minio.ErrorResponse{StatusCode: statusCode, Code: code, Message: code, BucketName: "backups"}
+	}
+
+	for _, test := range []struct {
+		err      error
+		name     string
+		expected bool
+	}{
+		{
+			name:     "SlowDown",
+			err:      errorResponse(http.StatusServiceUnavailable, "SlowDown"),
+			expected: true,
+		},
+		{
+			name:     "throttled without status",
+			err:      minio.ErrorResponse{Code: "Throttling"},
+			expected: true,
+		},
+		{
+			name:     "InternalError",
+			err:      errorResponse(http.StatusInternalServerError, "InternalError"),
+			expected: true,
+		},
+		{
+			name:     "bad gateway",
+			err:      errorResponse(http.StatusBadGateway, ""),
+			expected: true,
+		},
+		{
+			name:     "too many requests",
+			err:      errorResponse(http.StatusTooManyRequests, "TooManyRequests"),
+			expected: true,
+		},
+		{
+			name:     "wrapped SlowDown",
+			err:      fmt.Errorf("failed to upload part 3: %w", errorResponse(http.StatusServiceUnavailable, "SlowDown")),
+			expected: true,
+		},
+		{
+			name:     "connection reset",
+			err:      &url.Error{Op: "Put", URL: "https://s3.example.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}},
+			expected: true,
+		},
+		{
+			name:     "checksum mismatch",
+			err:      fmt.Errorf("failed to verify upload: %w", s3.ErrChecksumMismatch),
+			expected: true,
+		},
+		{
+			name: "AccessDenied",
+			err:  errorResponse(http.StatusForbidden, "AccessDenied"),
+		},
+		{
+			name: "wrapped AccessDenied",
+			err:  fmt.Errorf("failed to upload: %w", errorResponse(http.StatusForbidden, "AccessDenied")),
+		},
+		{
+			name: "NoSuchBucket",
+			err:  errorResponse(http.StatusNotFound, "NoSuchBucket"),
+		},
+		{
+			name: "InvalidAccessKeyId",
+			err:  errorResponse(http.StatusForbidden, "InvalidAccessKeyId"),
+		},
+		{
+			name: "SignatureDoesNotMatch",
+			err:  errorResponse(http.StatusForbidden, "SignatureDoesNotMatch"),
+		},
+		{
+			name: "untrusted certificate",
+			err:  &url.Error{Op: "Put", URL: "https://s3.example.com", Err: x509.UnknownAuthorityError{}},
+		},
+		{
+			name: "other",
+			err:  errors.New("invalid bucket name"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, s3.IsRetryable(test.err))
+		})
+	}
+}
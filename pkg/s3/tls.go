@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package s3
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	buconfig "github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// configureTLS applies the TLS options of tlsConf to tlsConfig.
+//
+// The CA bundle is added to the system roots, so that endpoints with public certificates keep working.
+func configureTLS(ctx context.Context, tlsConfig *tls.Config, tlsConf buconfig.S3TLSConfig) error {
+	tlsConfig.MinVersion = tlsConf.MinVersion
+
+	if tlsConf.CAFile != "" {
+		caBundle, err := os.ReadFile(tlsConf.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		rootCAs := tlsConfig.RootCAs
+		if rootCAs == nil {
+			if rootCAs, err = x509.SystemCertPool(); err != nil {
+				rootCAs = x509.NewCertPool()
+			}
+		}
+
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return fmt.Errorf("no certificates found in CA bundle %q", tlsConf.CAFile)
+		}
+
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if tlsConf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConf.CertFile, tlsConf.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsConf.InsecureSkipVerify {
+		logging.FromContext(ctx).Warn("S3 certificate verification is disabled, connections are vulnerable to interception; use S3_CA_FILE instead")
+
+		tlsConfig.InsecureSkipVerify = true //nolint:gosec
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package talos
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/siderolabs/talos/pkg/machinery/api/machine"
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+)
+
+// HealthReport is the result of the etcd pre-flight checks.
+type HealthReport struct {
+	// Problems lists the reasons etcd is considered unhealthy.
+	Problems []string
+	// Warnings lists findings which don't make etcd unhealthy, such as an unreachable member while a quorum is visible.
+	Warnings []string
+	// DBSize is the largest database size reported by the etcd members.
+	DBSize int64
+}
+
+// Healthy returns true if no problems were found.
+func (r *HealthReport) Healthy() bool {
+	return len(r.Problems) == 0
+}
+
+// String implements fmt.Stringer.
+func (r *HealthReport) String() string {
+	if len(r.Problems) == 0 && len(r.Warnings) == 0 {
+		return "ok"
+	}
+
+	return strings.Join(slices.Concat(r.Problems, r.Warnings), "; ")
+}
+
+// CheckEtcdHealth checks the etcd members on the control plane nodes for active alarms and a missing leader,
+// and the database size against growthFactor times the average of recentDBSizes.
+//
+// Members which fail to report their status or have no leader are only warned about if a quorum of the members
+// agrees on a leader, so that a single node being down doesn't prevent backups.
+// A database size larger than expected is a warning as well, as it may just be the cluster growing.
+// The size check is skipped if growthFactor is zero or there are no recent sizes.
+func CheckEtcdHealth(ctx context.Context, tc *talosclient.Client, recentDBSizes []int64, growthFactor float64) (*HealthReport, error) {
+	nodes, err := ControlPlaneNodes(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &HealthReport{}
+
+	statusResp, statusErr := tc.EtcdStatus(talosclient.WithNodes(ctx, nodes...))
+
+	responded := report.checkMembers(len(nodes), statusResp, statusErr)
+
+	// alarms are cluster wide, so any member which responded can list them
+	if len(responded) > 0 {
+		alarmResp, alarmErr := tc.EtcdAlarmList(talosclient.WithNode(ctx, responded[0]))
+
+		report.checkAlarms(alarmResp, alarmErr)
+	}
+
+	report.checkDBGrowth(recentDBSizes, growthFactor)
+
+	return report, nil
+}
+
+// checkMembers records the problems reported by the members in statusResp, out of nodeCount control plane nodes,
+// and returns the nodes which responded.
+func (r *HealthReport) checkMembers(nodeCount int, statusResp *machine.EtcdStatusResponse, statusErr error) []string {
+	var (
+		memberProblems []string
+		responded      []string
+	)
+
+	leaders := map[uint64]int{}
+
+	if statusErr != nil {
+		memberProblems = append(memberProblems, fmt.Sprintf("failed to get status: %s", statusErr))
+	}
+
+	for _, msg := range statusResp.GetMessages() {
+		status := msg.GetMemberStatus()
+		node := msg.GetMetadata().GetHostname()
+
+		responded = append(responded, node)
+
+		if status.GetLeader() == 0 {
+			memberProblems = append(memberProblems, fmt.Sprintf("member on node %q has no leader", node))
+		} else {
+			leaders[status.GetLeader()]++
+		}
+
+		for _, memberErr := range status.GetErrors() {
+			r.Problems = append(r.Problems, fmt.Sprintf("member on node %q reports error: %s", node, memberErr))
+		}
+
+		r.DBSize = max(r.DBSize, status.GetDbSize())
+	}
+
+	quorum := nodeCount/2 + 1
+
+	if slices.ContainsFunc(slices.Collect(maps.Values(leaders)), func(members int) bool { return members >= quorum }) {
+		r.Warnings = append(r.Warnings, memberProblems...)
+	} else {
+		r.Problems = append(r.Problems, memberProblems...)
+		r.Problems = append(r.Problems, fmt.Sprintf("no leader agreed on by a quorum of %d of %d members", quorum, nodeCount))
+	}
+
+	return responded
+}
+
+// checkAlarms records the active alarms in alarmResp.
+func (r *HealthReport) checkAlarms(alarmResp *machine.EtcdAlarmListResponse, alarmErr error) {
+	if alarmErr != nil {
+		r.Problems = append(r.Problems, fmt.Sprintf("failed to list alarms: %s", alarmErr))
+	}
+
+	for _, msg := range alarmResp.GetMessages() {
+		for _, alarm := range msg.GetMemberAlarms() {
+			if alarm.GetAlarm() == machine.EtcdMemberAlarm_NONE {
+				continue
+			}
+
+			r.Problems = append(r.Problems, fmt.Sprintf("member %x has active %s alarm", alarm.GetMemberId(), alarm.GetAlarm()))
+		}
+	}
+}
+
+// checkDBGrowth warns if the database size is larger than growthFactor times the average of recentDBSizes.
+func (r *HealthReport) checkDBGrowth(recentDBSizes []int64, growthFactor float64) {
+	if growthFactor <= 0 || len(recentDBSizes) == 0 {
+		return
+	}
+
+	var total int64
+
+	for _, size := range recentDBSizes {
+		total += size
+	}
+
+	average := float64(total) / float64(len(recentDBSizes))
+
+	if float64(r.DBSize) > average*growthFactor {
+		r.Warnings = append(r.Warnings,
+			fmt.Sprintf("database size %d bytes is more than %g times the average of recent backups (%.0f bytes)", r.DBSize, growthFactor, average))
+	}
+}
@@ -0,0 +1,234 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package talos
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/siderolabs/talos/pkg/machinery/api/common"
+	"github.com/siderolabs/talos/pkg/machinery/api/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+func memberStatus(node string, leader uint64, dbSize int64, errs ...string) *machine.EtcdStatus {
+	return &machine.EtcdStatus{
+		Metadata: &common.Metadata{Hostname: node},
+		MemberStatus: &machine.EtcdMemberStatus{
+			Leader: leader,
+			DbSize: dbSize,
+			Errors: errs,
+		},
+	}
+}
+
+func TestCheckMembers(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		statusErr         error
+		name              string
+		statuses          []*machine.EtcdStatus
+		expectedResponded []string
+		expectedProblems  []string
+		expectedWarnings  []string
+		nodeCount         int
+		expectedDBSize    int64
+	}{
+		{
+			name:      "healthy",
+			nodeCount: 3,
+			statuses: []*machine.EtcdStatus{
+				memberStatus("cp-1", 1, 100),
+				memberStatus("cp-2", 1, 300),
+				memberStatus("cp-3", 1, 200),
+			},
+			expectedResponded: []string{"cp-1", "cp-2", "cp-3"},
+			expectedDBSize:    300,
+		},
+		{
+			name:      "one member unreachable",
+			nodeCount: 3,
+			statusErr: errors.New("cp-3: connection refused"),
+			statuses: []*machine.EtcdStatus{
+				memberStatus("cp-1", 1, 100),
+				memberStatus("cp-2", 1, 100),
+			},
+			expectedResponded: []string{"cp-1", "cp-2"},
+			expectedWarnings:  []string{"failed to get status: cp-3: connection refused"},
+			expectedDBSize:    100,
+		},
+		{
+			name:      "one member without leader",
+			nodeCount: 3,
+			statuses: []*machine.EtcdStatus{
+				memberStatus("cp-1", 1, 100),
+				memberStatus("cp-2", 1, 100),
+				memberStatus("cp-3", 0, 100),
+			},
+			expectedResponded: []string{"cp-1", "cp-2", "cp-3"},
+			expectedWarnings:  []string{`member on node "cp-3" has no leader`},
+			expectedDBSize:    100,
+		},
+		{
+			name:      "no quorum",
+			nodeCount: 3,
+			statusErr: errors.New("cp-2, cp-3: connection refused"),
+			statuses: []*machine.EtcdStatus{
+				memberStatus("cp-1", 1, 100),
+			},
+			expectedResponded: []string{"cp-1"},
+			expectedProblems: []string{
+				"failed to get status: cp-2, cp-3: connection refused",
+				"no leader agreed on by a quorum of 2 of 3 members",
+			},
+			expectedDBSize: 100,
+		},
+		{
+			name:      "split leaders",
+			nodeCount: 4,
+			statuses: []*machine.EtcdStatus{
+				memberStatus("cp-1", 1, 100),
+				memberStatus("cp-2", 1, 100),
+				memberStatus("cp-3", 2, 100),
+				memberStatus("cp-4", 2, 100),
+			},
+			expectedResponded: []string{"cp-1", "cp-2", "cp-3", "cp-4"},
+			expectedProblems:  []string{"no leader agreed on by a quorum of 3 of 4 members"},
+			expectedDBSize:    100,
+		},
+		{
+			name:      "member errors",
+			nodeCount: 1,
+			statuses: []*machine.EtcdStatus{
+				memberStatus("cp-1", 1, 100, "corrupt"),
+			},
+			expectedResponded: []string{"cp-1"},
+			expectedProblems:  []string{`member on node "cp-1" reports error: corrupt`},
+			expectedDBSize:    100,
+		},
+		{
+			name:             "no response",
+			nodeCount:        1,
+			statusErr:        errors.New("connection refused"),
+			expectedProblems: []string{"failed to get status: connection refused", "no leader agreed on by a quorum of 1 of 1 members"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var statusResp *machine.EtcdStatusResponse
+
+			if test.statuses != nil {
+				statusResp = &machine.EtcdStatusResponse{Messages: test.statuses}
+			}
+
+			report := &HealthReport{}
+
+			responded := report.checkMembers(test.nodeCount, statusResp, test.statusErr)
+
+			assert.Equal(t, test.expectedResponded, responded)
+			assert.Equal(t, test.expectedProblems, report.Problems)
+			assert.Equal(t, test.expectedWarnings, report.Warnings)
+			assert.Equal(t, test.expectedDBSize, report.DBSize)
+			assert.Equal(t, len(test.expectedProblems) == 0, report.Healthy())
+		})
+	}
+}
+
+func TestCheckAlarms(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		alarmErr         error
+		name             string
+		alarms           []*machine.EtcdMemberAlarm
+		expectedProblems []string
+	}{
+		{
+			name: "no alarms",
+		},
+		{
+			name: "none alarm",
+			alarms: []*machine.EtcdMemberAlarm{
+				{MemberId: 0xa, Alarm: machine.EtcdMemberAlarm_NONE},
+			},
+		},
+		{
+			name: "active alarms",
+			alarms: []*machine.EtcdMemberAlarm{
+				{MemberId: 0xa, Alarm: machine.EtcdMemberAlarm_NOSPACE},
+				{MemberId: 0xb, Alarm: machine.EtcdMemberAlarm_NONE},
+				{MemberId: 0xc, Alarm: machine.EtcdMemberAlarm_CORRUPT},
+			},
+			expectedProblems: []string{"member a has active NOSPACE alarm", "member c has active CORRUPT alarm"},
+		},
+		{
+			name:             "failed to list",
+			alarmErr:         errors.New("unavailable"),
+			expectedProblems: []string{"failed to list alarms: unavailable"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			report := &HealthReport{}
+
+			report.checkAlarms(&machine.EtcdAlarmListResponse{
+				Messages: []*machine.EtcdAlarm{{MemberAlarms: test.alarms}},
+			}, test.alarmErr)
+
+			assert.Equal(t, test.expectedProblems, report.Problems)
+			assert.Empty(t, report.Warnings)
+		})
+	}
+}
+
+func TestCheckDBGrowth(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name          string
+		recentDBSizes []int64
+		growthFactor  float64
+		dbSize        int64
+		warned        bool
+	}{
+		{
+			name:          "within factor",
+			recentDBSizes: []int64{100, 200, 300},
+			growthFactor:  2,
+			dbSize:        400,
+		},
+		{
+			name:          "exceeds factor",
+			recentDBSizes: []int64{100, 200, 300},
+			growthFactor:  2,
+			dbSize:        401,
+			warned:        true,
+		},
+		{
+			name:         "no recent sizes",
+			growthFactor: 2,
+			dbSize:       1 << 30,
+		},
+		{
+			name:          "disabled",
+			recentDBSizes: []int64{100},
+			dbSize:        1 << 30,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			report := &HealthReport{DBSize: test.dbSize}
+
+			report.checkDBGrowth(test.recentDBSizes, test.growthFactor)
+
+			assert.Equal(t, test.warned, len(report.Warnings) == 1)
+			assert.Empty(t, report.Problems)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package talos
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/safe"
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+	"github.com/siderolabs/talos/pkg/machinery/resources/config"
+
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// SaveMachineConfigs reads the active machine configuration of every control plane node
+// and saves them locally as a tar archive with a <node>.yaml file per node.
+//
+// Reading machine configurations requires the os:admin role.
+func SaveMachineConfigs(ctx context.Context, tc *talosclient.Client, clusterName string, timeStamp time.Time) (string, error) {
+	nodes, err := ControlPlaneNodes(ctx, tc)
+	if err != nil {
+		return "", err
+	}
+
+	archivePath := fmt.Sprintf("%s-%s.machineconfig.tar", clusterName, timeStamp.Format(time.RFC3339))
+	partPath := archivePath + ".part"
+
+	defer os.RemoveAll(partPath) //nolint:errcheck
+
+	dest, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("error creating temp file: %w", err)
+	}
+
+	defer dest.Close() //nolint:errcheck
+
+	tw := tar.NewWriter(dest)
+
+	for _, node := range nodes {
+		cfg, err := machineConfig(ctx, tc, node)
+		if err != nil {
+			return "", err
+		}
+
+		cfgBytes, err := cfg.Provider().Bytes()
+		if err != nil {
+			return "", fmt.Errorf("error encoding machine config of node %q: %w", node, err)
+		}
+
+		if err = tw.WriteHeader(&tar.Header{
+			Name:    node + ".yaml",
+			Mode:    0o600,
+			Size:    int64(len(cfgBytes)),
+			ModTime: timeStamp,
+		}); err != nil {
+			return "", fmt.Errorf("error writing archive: %w", err)
+		}
+
+		if _, err = tw.Write(cfgBytes); err != nil {
+			return "", fmt.Errorf("error writing archive: %w", err)
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return "", fmt.Errorf("error writing archive: %w", err)
+	}
+
+	if err = dest.Sync(); err != nil {
+		return "", fmt.Errorf("error fsyncing: %w", err)
+	}
+
+	if err = os.Rename(partPath, archivePath); err != nil {
+		return "", fmt.Errorf("error renaming archive: %w", err)
+	}
+
+	logging.FromContext(ctx).Info("machine configs saved", "path", archivePath, "nodes", len(nodes))
+
+	return archivePath, nil
+}
+
+// machineConfig reads the active machine configuration of node.
+func machineConfig(ctx context.Context, tc *talosclient.Client, node string) (*config.MachineConfig, error) {
+	cfg, err := safe.ReaderGetByID[*config.MachineConfig](talosclient.WithNode(ctx, node), tc.COSI, config.ActiveID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading machine config of node %q: %w", node, err)
+	}
+
+	return cfg, nil
+}
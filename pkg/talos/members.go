@@ -0,0 +1,113 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package talos
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+
+	"github.com/siderolabs/talos/pkg/machinery/api/machine"
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// Member is an etcd member running on a control plane node.
+type Member struct {
+	// Node is the address used to target the node via the Talos API.
+	Node             string
+	ID               uint64
+	RaftAppliedIndex uint64
+	Leader           bool
+	Healthy          bool
+}
+
+// ControlPlaneNodes returns the addresses of the control plane nodes running etcd voting members.
+func ControlPlaneNodes(ctx context.Context, tc *talosclient.Client) ([]string, error) {
+	resp, err := tc.EtcdMemberList(ctx, &machine.EtcdMemberListRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing etcd members: %w", err)
+	}
+
+	var nodes []string
+
+	for _, msg := range resp.GetMessages() {
+		for _, member := range msg.GetMembers() {
+			if member.GetIsLearner() || len(member.GetPeerUrls()) == 0 {
+				continue
+			}
+
+			u, err := url.Parse(member.GetPeerUrls()[0])
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer URL of member %q: %w", member.GetHostname(), err)
+			}
+
+			if node := u.Hostname(); !slices.Contains(nodes, node) {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no etcd members found")
+	}
+
+	return nodes, nil
+}
+
+// SnapshotCandidates returns the etcd members of nodes in the order they should be used to take a snapshot:
+// healthy followers which are the most up to date first, then the leader and finally members which are unhealthy
+// or failed to report their status.
+func SnapshotCandidates(ctx context.Context, tc *talosclient.Client, nodes []string) []Member {
+	members := make([]Member, 0, len(nodes))
+
+	resp, err := tc.EtcdStatus(talosclient.WithNodes(ctx, nodes...))
+	if err != nil {
+		logging.FromContext(ctx).Warn("error getting etcd status from some nodes", logging.Error(err))
+	}
+
+	for _, msg := range resp.GetMessages() {
+		status := msg.GetMemberStatus()
+
+		members = append(members, Member{
+			Node:             msg.GetMetadata().GetHostname(),
+			ID:               status.GetMemberId(),
+			RaftAppliedIndex: status.GetRaftAppliedIndex(),
+			Leader:           status.GetMemberId() == status.GetLeader(),
+			Healthy:          len(status.GetErrors()) == 0 && !status.GetIsLearner() && status.GetLeader() != 0,
+		})
+	}
+
+	for _, node := range nodes {
+		if !slices.ContainsFunc(members, func(m Member) bool { return m.Node == node }) {
+			members = append(members, Member{Node: node})
+		}
+	}
+
+	slices.SortStableFunc(members, func(a, b Member) int {
+		return cmp.Or(
+			compareBool(a.Healthy, b.Healthy),
+			compareBool(!a.Leader, !b.Leader),
+			cmp.Compare(b.RaftAppliedIndex, a.RaftAppliedIndex),
+		)
+	})
+
+	return members
+}
+
+// compareBool orders true before false.
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return -1
+	default:
+		return 1
+	}
+}
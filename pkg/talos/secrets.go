@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package talos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
+	"github.com/siderolabs/talos/pkg/machinery/config/generate/secrets"
+	"gopkg.in/yaml.v3"
+
+	"github.com/siderolabs/talos-backup/pkg/logging"
+)
+
+// SaveSecretsBundle derives the secrets bundle from the machine configuration of a control plane node
+// and saves it locally in the format produced by `talosctl gen secrets`.
+//
+// Reading machine configurations requires the os:admin role.
+func SaveSecretsBundle(ctx context.Context, tc *talosclient.Client, clusterName string, timeStamp time.Time) (string, error) {
+	nodes, err := ControlPlaneNodes(ctx, tc)
+	if err != nil {
+		return "", err
+	}
+
+	var errs error
+
+	for _, node := range nodes {
+		cfg, cfgErr := machineConfig(ctx, tc, node)
+		if cfgErr != nil {
+			errs = errors.Join(errs, cfgErr)
+
+			continue
+		}
+
+		bundle := secrets.NewBundleFromConfig(secrets.NewFixedClock(timeStamp), cfg.Config())
+
+		bundleBytes, err := yaml.Marshal(bundle)
+		if err != nil {
+			return "", fmt.Errorf("error encoding secrets bundle: %w", err)
+		}
+
+		bundlePath := fmt.Sprintf("%s-%s.secrets.yaml", clusterName, timeStamp.Format(time.RFC3339))
+
+		if err = os.WriteFile(bundlePath, bundleBytes, 0o600); err != nil {
+			return "", fmt.Errorf("error writing secrets bundle: %w", err)
+		}
+
+		logging.FromContext(ctx).Info("secrets bundle saved", "path", bundlePath, logging.KeyNode, node)
+
+		return bundlePath, nil
+	}
+
+	return "", errs
+}
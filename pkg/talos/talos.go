@@ -8,17 +8,28 @@ package talos
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/siderolabs/talos/pkg/machinery/api/machine"
 	talosclient "github.com/siderolabs/talos/pkg/machinery/client"
 	talosconfig "github.com/siderolabs/talos/pkg/machinery/client/config"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/siderolabs/talos-backup/pkg/config"
+	"github.com/siderolabs/talos-backup/pkg/logging"
+	"github.com/siderolabs/talos-backup/pkg/metrics"
+	"github.com/siderolabs/talos-backup/pkg/ratelimit"
+	"github.com/siderolabs/talos-backup/pkg/retry"
+	"github.com/siderolabs/talos-backup/pkg/tracing"
 )
 
 // CreateClient returns a talos API client given a talosconfig string.
@@ -36,50 +47,163 @@ func CreateClient(ctx context.Context, talosSecret string) (*talosclient.Client,
 	return talosclient.New(ctx, talosclient.WithConfig(t))
 }
 
+// Snapshot is an etcd snapshot saved locally.
+type Snapshot struct {
+	SnapshotStatus
+
+	Timestamp time.Time
+	Path      string
+	// Node is the control plane node the snapshot was taken from, empty if the client's default node was used.
+	Node string
+}
+
 // TakeEtcdSnapshot will take an etcd snapshot given a talos client
 // and save/validate it locally.
-func TakeEtcdSnapshot(ctx context.Context, tc *talosclient.Client, clusterName string) (string, error) {
+//
+// The snapshot is taken from a healthy etcd follower if there is one, falling back
+// to the remaining control plane nodes if that fails.
+// If all nodes fail with transient errors, this is retried with backoff as configured.
+// A snapshot which fails validation is removed and a *ValidationError is returned.
+// Reading the snapshot is limited to rateLimit bytes per second, unless it is zero.
+func TakeEtcdSnapshot(ctx context.Context, tc *talosclient.Client, clusterName string, retryConfig config.RetryConfig, rateLimit int64) (*Snapshot, error) {
 	timeStamp := time.Now()
+	limiter := ratelimit.NewLimiter(rateLimit)
 
 	dbPath := fmt.Sprintf("%s-%s.snap", clusterName, timeStamp.Format(time.RFC3339))
+
+	var snapshot *Snapshot
+
+	err := retry.Do(ctx, retryConfig, "etcd snapshot", IsRetryable, func(ctx context.Context) error {
+		var err error
+
+		snapshot, err = takeEtcdSnapshotFromCandidates(ctx, tc, limiter, clusterName, dbPath, timeStamp)
+
+		return err
+	})
+
+	return snapshot, err
+}
+
+// IsRetryable returns true if err, or any error joined in it, is a transient Talos API or network error or a snapshot
+// failing validation, which may have been truncated.
+func IsRetryable(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok { //nolint:errorlint
+		return slices.ContainsFunc(joined.Unwrap(), IsRetryable)
+	}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return true
+	}
+
+	var statusErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &statusErr) {
+		switch statusErr.GRPCStatus().Code() { //nolint:exhaustive
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			return true
+		default:
+			return false
+		}
+	}
+
+	return retry.IsNetworkError(err)
+}
+
+func takeEtcdSnapshotFromCandidates(ctx context.Context, tc *talosclient.Client, limiter *rate.Limiter, clusterName, dbPath string, timeStamp time.Time) (*Snapshot, error) {
+	nodes, err := ControlPlaneNodes(ctx, tc)
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to discover control plane nodes, using the default node", logging.Error(err))
+
+		return takeEtcdSnapshot(ctx, tc, limiter, clusterName, dbPath, "", timeStamp)
+	}
+
+	var errs error
+
+	for i, member := range SnapshotCandidates(ctx, tc, nodes) {
+		if i > 0 {
+			metrics.ObserveRetry(clusterName, metrics.StageSnapshot)
+		}
+
+		logging.FromContext(ctx).Info("taking etcd snapshot", logging.KeyNode, member.Node, "healthy", member.Healthy, "leader", member.Leader)
+
+		snapshot, snapshotErr := takeEtcdSnapshot(talosclient.WithNode(ctx, member.Node), tc, limiter, clusterName, dbPath, member.Node, timeStamp)
+		if snapshotErr == nil {
+			return snapshot, nil
+		}
+
+		logging.FromContext(ctx).Warn("failed to take etcd snapshot", logging.KeyNode, member.Node, logging.Error(snapshotErr))
+
+		errs = errors.Join(errs, fmt.Errorf("node %q: %w", member.Node, snapshotErr))
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errs
+}
+
+func takeEtcdSnapshot(
+	ctx context.Context, tc *talosclient.Client, limiter *rate.Limiter, clusterName, dbPath, node string, timeStamp time.Time,
+) (snapshot *Snapshot, err error) {
+	ctx, span := tracing.Start(ctx, "EtcdSnapshot")
+	span.SetAttributes(attribute.String(logging.KeyNode, node))
+
+	defer func() { tracing.End(span, err) }()
+
 	partPath := dbPath + ".part"
 
 	defer os.RemoveAll(partPath) //nolint:errcheck
 
 	dest, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
-		return "", fmt.Errorf("error creating temp file: %w", err)
+		return nil, fmt.Errorf("error creating temp file: %w", err)
 	}
 
 	defer dest.Close() //nolint:errcheck
 
+	start := time.Now()
+
 	r, err := tc.EtcdSnapshot(ctx, &machine.EtcdSnapshotRequest{})
 	if err != nil {
-		return "", fmt.Errorf("error taking snapshot: %w", err)
+		return nil, fmt.Errorf("error taking snapshot: %w", err)
 	}
 
 	defer r.Close() //nolint:errcheck
 
-	size, err := io.Copy(dest, r)
-	if err != nil {
-		return "", fmt.Errorf("error reading: %w", err)
+	verifier := NewHashVerifier()
+
+	if _, err = io.Copy(io.MultiWriter(dest, verifier), ratelimit.NewReader(ctx, r, limiter)); err != nil {
+		return nil, fmt.Errorf("error reading: %w", err)
 	}
 
+	elapsed := time.Since(start)
+
 	if err = dest.Sync(); err != nil {
-		return "", fmt.Errorf("error fsyncing: %w", err)
+		return nil, fmt.Errorf("error fsyncing: %w", err)
 	}
 
-	// TODO: probably need to clean up the snap if there's an issue w/ it
-	// this check is from https://github.com/etcd-io/etcd/blob/client/v3.5.0-alpha.0/client/v3/snapshot/v3_snapshot.go#L46
-	if (size % 512) != sha256.Size {
-		return "", fmt.Errorf("sha256 checksum not found (size %d)", size)
+	if err = verifier.Verify(); err != nil {
+		return nil, &ValidationError{Path: dbPath, Reason: "integrity check failed", Err: err}
+	}
+
+	status, err := ValidateSnapshot(partPath)
+	if err != nil {
+		return nil, err
 	}
 
 	if err = os.Rename(partPath, dbPath); err != nil {
-		return "", fmt.Errorf("sha256 checksum not found (size %d)", size)
+		return nil, fmt.Errorf("error renaming snapshot: %w", err)
 	}
 
-	log.Printf("etcd snapshot for cluster %q saved to %q (%d bytes)\n", clusterName, dbPath, size)
+	logging.FromContext(ctx).Info("etcd snapshot saved",
+		"path", dbPath, logging.KeyNode, node, logging.KeyBytes, verifier.Size(),
+		logging.KeyBytesPerSecond, ratelimit.BytesPerSecond(verifier.Size(), elapsed), "revision", status.Revision, "consistent_index", status.ConsistentIndex)
 
-	return dbPath, nil
+	return &Snapshot{
+		SnapshotStatus: *status,
+		Timestamp:      timeStamp,
+		Path:           dbPath,
+		Node:           node,
+	}, nil
 }
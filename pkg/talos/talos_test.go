@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package talos_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/siderolabs/talos-backup/pkg/talos"
+)
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		err      error
+		name     string
+		expected bool
+	}{
+		{
+			name:     "unavailable",
+			err:      status.Error(codes.Unavailable, "connection error"),
+			expected: true,
+		},
+		{
+			name:     "deadline exceeded",
+			err:      status.Error(codes.DeadlineExceeded, "context deadline exceeded"),
+			expected: true,
+		},
+		{
+			name:     "resource exhausted",
+			err:      status.Error(codes.ResourceExhausted, "too many requests"),
+			expected: true,
+		},
+		{
+			name:     "wrapped unavailable",
+			err:      fmt.Errorf("failed to take etcd snapshot: %w", status.Error(codes.Unavailable, "connection error")),
+			expected: true,
+		},
+		{
+			name:     "connection reset",
+			err:      &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			expected: true,
+		},
+		{
+			name:     "invalid snapshot",
+			err:      &talos.ValidationError{Path: "db.snapshot", Reason: "truncated"},
+			expected: true,
+		},
+		{
+			name:     "joined with a transient error",
+			err:      errors.Join(status.Error(codes.PermissionDenied, "denied"), status.Error(codes.Unavailable, "connection error")),
+			expected: true,
+		},
+		{
+			name: "permission denied",
+			err:  status.Error(codes.PermissionDenied, "not authorized"),
+		},
+		{
+			name: "unauthenticated",
+			err:  status.Error(codes.Unauthenticated, "certificate expired"),
+		},
+		{
+			name: "not found",
+			err:  status.Error(codes.NotFound, "etcd is not running"),
+		},
+		{
+			name: "joined permanent errors",
+			err:  errors.Join(status.Error(codes.PermissionDenied, "denied"), status.Error(codes.InvalidArgument, "invalid")),
+		},
+		{
+			name: "other",
+			err:  errors.New("no control plane nodes"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, talos.IsRetryable(test.err))
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package talos
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	keyBucket          = []byte("key")
+	metaBucket         = []byte("meta")
+	consistentIndexKey = []byte("consistent_index")
+)
+
+// ValidationError is returned when an etcd snapshot is corrupt or unreadable.
+type ValidationError struct {
+	Err    error
+	Path   string
+	Reason string
+}
+
+// Error implements error.
+func (e *ValidationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("invalid etcd snapshot %q: %s: %s", e.Path, e.Reason, e.Err)
+	}
+
+	return fmt.Sprintf("invalid etcd snapshot %q: %s", e.Path, e.Reason)
+}
+
+// Unwrap returns the underlying error.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// SnapshotStatus describes the contents of a validated etcd snapshot.
+type SnapshotStatus struct {
+	Size            int64
+	Revision        int64
+	ConsistentIndex uint64
+}
+
+// HashVerifier computes the sha256 of everything written to it except the
+// trailing sha256.Size bytes, which etcd appends as the snapshot checksum.
+type HashVerifier struct {
+	hash hash.Hash
+	tail []byte
+	size int64
+}
+
+// NewHashVerifier returns a new HashVerifier.
+func NewHashVerifier() *HashVerifier {
+	return &HashVerifier{
+		hash: sha256.New(),
+	}
+}
+
+// Write implements io.Writer.
+func (v *HashVerifier) Write(p []byte) (int, error) {
+	v.size += int64(len(p))
+	v.tail = append(v.tail, p...)
+
+	if excess := len(v.tail) - sha256.Size; excess > 0 {
+		v.hash.Write(v.tail[:excess]) //nolint:errcheck
+		v.tail = append(v.tail[:0], v.tail[excess:]...)
+	}
+
+	return len(p), nil
+}
+
+// Size returns the number of bytes written so far, including the trailer.
+func (v *HashVerifier) Size() int64 {
+	return v.size
+}
+
+// Verify checks that the trailer matches the hash of the preceding bytes.
+func (v *HashVerifier) Verify() error {
+	// this check is from https://github.com/etcd-io/etcd/blob/client/v3.5.0-alpha.0/client/v3/snapshot/v3_snapshot.go#L46
+	if (v.size % 512) != sha256.Size {
+		return fmt.Errorf("sha256 checksum not found (size %d)", v.size)
+	}
+
+	if !bytes.Equal(v.hash.Sum(nil), v.tail) {
+		return fmt.Errorf("sha256 checksum mismatch (size %d)", v.size)
+	}
+
+	return nil
+}
+
+// VerifySnapshotHash reads an etcd snapshot from r and verifies its sha256 trailer.
+func VerifySnapshotHash(r io.Reader) (int64, error) {
+	v := NewHashVerifier()
+
+	if _, err := io.Copy(v, r); err != nil {
+		return v.Size(), err
+	}
+
+	return v.Size(), v.Verify()
+}
+
+// ValidateSnapshot opens the etcd snapshot at path read-only and checks that
+// the database is readable and contains the buckets etcd needs to restore from it.
+func ValidateSnapshot(path string) (*SnapshotStatus, error) {
+	db, err := bbolt.Open(path, 0o400, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, &ValidationError{Path: path, Reason: "failed to open database", Err: err}
+	}
+
+	defer db.Close() //nolint:errcheck
+
+	status := &SnapshotStatus{}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		status.Size = tx.Size()
+
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return &ValidationError{Path: path, Reason: "bucket \"meta\" not found"}
+		}
+
+		if index := meta.Get(consistentIndexKey); len(index) == 8 {
+			status.ConsistentIndex = binary.BigEndian.Uint64(index)
+		}
+
+		keys := tx.Bucket(keyBucket)
+		if keys == nil {
+			return &ValidationError{Path: path, Reason: "bucket \"key\" not found"}
+		}
+
+		// keys are revisions encoded as 8 bytes of big endian main revision, '_' and 8 bytes of sub revision
+		if lastKey, _ := keys.Cursor().Last(); len(lastKey) >= 8 {
+			status.Revision = int64(binary.BigEndian.Uint64(lastKey[:8]))
+		}
+
+		return nil
+	})
+	if err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, err
+		}
+
+		return nil, &ValidationError{Path: path, Reason: "failed to read database", Err: err}
+	}
+
+	return status, nil
+}
@@ -0,0 +1,249 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package talos_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/siderolabs/talos-backup/pkg/talos"
+)
+
+// snapshotWithTrailer returns size bytes of data followed by their sha256, as etcd appends it.
+func snapshotWithTrailer(size int) []byte {
+	data := bytes.Repeat([]byte("etcd"), size/4+1)[:size]
+	sum := sha256.Sum256(data)
+
+	return append(data, sum[:]...)
+}
+
+func TestHashVerifier(t *testing.T) {
+	t.Parallel()
+
+	valid := snapshotWithTrailer(4096)
+
+	corrupted := bytes.Clone(valid)
+	corrupted[100] ^= 0xff
+
+	badTrailer := bytes.Clone(valid)
+	badTrailer[len(badTrailer)-1] ^= 0xff
+
+	for _, test := range []struct {
+		name        string
+		data        []byte
+		chunkSize   int
+		expectedErr string
+	}{
+		{
+			name:      "single write",
+			data:      valid,
+			chunkSize: len(valid),
+		},
+		{
+			name:      "byte by byte",
+			data:      valid,
+			chunkSize: 1,
+		},
+		{
+			name:      "trailer split across writes",
+			data:      valid,
+			chunkSize: 4096 + sha256.Size/2,
+		},
+		{
+			name:      "odd chunks",
+			data:      valid,
+			chunkSize: 7,
+		},
+		{
+			name:        "truncated",
+			data:        valid[:len(valid)-1],
+			chunkSize:   512,
+			expectedErr: "sha256 checksum not found (size 4127)",
+		},
+		{
+			name:        "truncated to the body",
+			data:        valid[:4096],
+			chunkSize:   512,
+			expectedErr: "sha256 checksum not found (size 4096)",
+		},
+		{
+			name:        "empty",
+			chunkSize:   1,
+			expectedErr: "sha256 checksum not found (size 0)",
+		},
+		{
+			name:        "corrupted body",
+			data:        corrupted,
+			chunkSize:   100,
+			expectedErr: "sha256 checksum mismatch (size 4128)",
+		},
+		{
+			name:        "corrupted trailer",
+			data:        badTrailer,
+			chunkSize:   100,
+			expectedErr: "sha256 checksum mismatch (size 4128)",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			v := talos.NewHashVerifier()
+
+			for data := test.data; len(data) > 0; {
+				n, err := v.Write(data[:min(test.chunkSize, len(data))])
+				require.NoError(t, err)
+
+				data = data[n:]
+			}
+
+			assert.Equal(t, int64(len(test.data)), v.Size())
+
+			if test.expectedErr != "" {
+				assert.EqualError(t, v.Verify(), test.expectedErr)
+			} else {
+				assert.NoError(t, v.Verify())
+			}
+		})
+	}
+}
+
+func TestVerifySnapshotHash(t *testing.T) {
+	t.Parallel()
+
+	size, err := talos.VerifySnapshotHash(bytes.NewReader(snapshotWithTrailer(1024)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024+sha256.Size), size)
+
+	_, err = talos.VerifySnapshotHash(bytes.NewReader(snapshotWithTrailer(1000)))
+	assert.Error(t, err)
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	t.Parallel()
+
+	revisionKey := func(main, sub uint64) []byte {
+		key := binary.BigEndian.AppendUint64(nil, main)
+		key = append(key, '_')
+
+		return binary.BigEndian.AppendUint64(key, sub)
+	}
+
+	for _, test := range []struct {
+		setup                   func(*bbolt.Tx) error
+		name                    string
+		expectedErr             string
+		expectedRevision        int64
+		expectedConsistentIndex uint64
+	}{
+		{
+			name: "valid",
+			setup: func(tx *bbolt.Tx) error {
+				meta, err := tx.CreateBucket([]byte("meta"))
+				if err != nil {
+					return err
+				}
+
+				if err = meta.Put([]byte("consistent_index"), binary.BigEndian.AppendUint64(nil, 42)); err != nil {
+					return err
+				}
+
+				keys, err := tx.CreateBucket([]byte("key"))
+				if err != nil {
+					return err
+				}
+
+				for _, key := range [][]byte{revisionKey(7, 0), revisionKey(12, 1), revisionKey(12, 0)} {
+					if err = keys.Put(key, []byte("value")); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			},
+			expectedRevision:        12,
+			expectedConsistentIndex: 42,
+		},
+		{
+			name: "empty buckets",
+			setup: func(tx *bbolt.Tx) error {
+				if _, err := tx.CreateBucket([]byte("meta")); err != nil {
+					return err
+				}
+
+				_, err := tx.CreateBucket([]byte("key"))
+
+				return err
+			},
+		},
+		{
+			name: "missing meta bucket",
+			setup: func(tx *bbolt.Tx) error {
+				_, err := tx.CreateBucket([]byte("key"))
+
+				return err
+			},
+			expectedErr: `bucket "meta" not found`,
+		},
+		{
+			name: "missing key bucket",
+			setup: func(tx *bbolt.Tx) error {
+				_, err := tx.CreateBucket([]byte("meta"))
+
+				return err
+			},
+			expectedErr: `bucket "key" not found`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "etcd.snap")
+
+			db, err := bbolt.Open(path, 0o600, nil)
+			require.NoError(t, err)
+			require.NoError(t, db.Update(test.setup))
+			require.NoError(t, db.Close())
+
+			status, err := talos.ValidateSnapshot(path)
+
+			if test.expectedErr != "" {
+				var validationErr *talos.ValidationError
+
+				require.ErrorAs(t, err, &validationErr)
+				assert.Equal(t, test.expectedErr, validationErr.Reason)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedRevision, status.Revision)
+			assert.Equal(t, test.expectedConsistentIndex, status.ConsistentIndex)
+			assert.Positive(t, status.Size)
+		})
+	}
+}
+
+func TestValidateSnapshotNotADatabase(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "etcd.snap")
+
+	require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("not a bolt database"), 512), 0o600))
+
+	_, err := talos.ValidateSnapshot(path)
+
+	var validationErr *talos.ValidationError
+
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "failed to open database", validationErr.Reason)
+}
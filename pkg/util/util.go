@@ -6,13 +6,15 @@
 package util
 
 import (
-	"log"
+	"context"
 	"os"
+
+	"github.com/siderolabs/talos-backup/pkg/logging"
 )
 
 // CleanupFile removes the file at filePath and logs an error if there is one.
-func CleanupFile(filePath string) {
+func CleanupFile(ctx context.Context, filePath string) {
 	if err := os.Remove(filePath); err != nil {
-		log.Printf("error cleaning up file %q: %q", filePath, err)
+		logging.FromContext(ctx).Error("error cleaning up file", "path", filePath, logging.Error(err))
 	}
 }